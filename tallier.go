@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"math"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/reddit/tallier/tally"
@@ -21,6 +25,31 @@ var interfaceFlag = flag.String("interface", "",
 var portFlag = flag.Int("port", 8081,
 	"udp port to listen for statgrams and tcp port to serve status pages")
 
+var tcpPortFlag = flag.Int("tcpPort", 0,
+	"tcp port to accept newline-delimited statgrams on (0 to disable)")
+
+var unixDatagramFlag = flag.String("unixDatagram", "",
+	"path of a unix datagram socket to receive statgrams on")
+
+var unixStreamFlag = flag.String("unixStream", "",
+	"path of a unix stream socket to accept newline-delimited statgrams on")
+
+var unixSocketModeFlag = flag.String("unixSocketMode", "0660",
+	"file mode (in octal) for unix sockets")
+
+var unixSocketOwnerFlag = flag.String("unixSocketOwner", "",
+	"user to own unix sockets (defaults to the user tallier runs as)")
+
+var unixSocketGroupFlag = flag.String("unixSocketGroup", "",
+	"group to own unix sockets (defaults to the group tallier runs as)")
+
+var reusePortFlag = flag.Bool("reusePort", false,
+	"give each worker its own udp socket using SO_REUSEPORT (linux only)")
+
+var receiveBufferFlag = flag.Int("receiveBuffer", 0,
+	"size in bytes of the kernel receive buffer for udp sockets (0 for the "+
+		"system default)")
+
 var numWorkersFlag = flag.Int("numWorkers",
 	int(math.Max(1, float64(runtime.NumCPU()-1))),
 	"number of parallel workers for parsing and accumulating stats")
@@ -29,8 +58,130 @@ var flushIntervalFlag = flag.Duration("flushInterval",
 	time.Duration(4)*time.Second,
 	"interval at which stats are flushed to graphite")
 
+var reportQueueSizeFlag = flag.Int("reportQueueSize",
+	tally.DEFAULT_REPORT_QUEUE_SIZE,
+	"most reports to hold for each graphite destination while it's "+
+		"unavailable, dropping the oldest beyond that")
+
+var spoolDirFlag = flag.String("spoolDir", "",
+	"directory for reports that can't be delivered to graphite once "+
+		"-reportQueueSize is reached")
+
+var spoolMaxBytesFlag = flag.Int64("spoolMaxBytes",
+	tally.DEFAULT_SPOOL_MAX_BYTES,
+	"most bytes of reports to keep in -spoolDir for each graphite destination, "+
+		"dropping the oldest beyond that")
+
+var shutdownTimeoutFlag = flag.Duration("shutdownTimeout",
+	tally.DEFAULT_SHUTDOWN_TIMEOUT,
+	"time allowed for sending a final report to graphite on SIGTERM or SIGINT")
+
+var timerAccuracyFlag = flag.Float64("timerAccuracy",
+	tally.DEFAULT_TIMER_ACCURACY,
+	"relative accuracy of reported timer percentiles (e.g. 0.01 for 1%)")
+
+var timerPercentilesFlag = append(tally.TimerPercentiles{},
+	tally.DefaultTimerPercentiles...)
+
+var timerHistogramsFlag tally.TimerHistograms
+
+var tagFormatFlag tally.TagFormat
+
+var graphiteProtocolFlag tally.GraphiteProtocol
+
+var graphiteRoutingFlag tally.GraphiteRouting
+
+var prometheusMappingsFlag tally.StatMappings
+
+var influxMappingsFlag tally.StatMappings
+
+var openTSDBMappingsFlag tally.StatMappings
+
+func init() {
+	flag.Var(&timerPercentilesFlag, "timerPercentiles",
+		"comma-separated percentiles to report for each timer")
+	flag.Var(&timerHistogramsFlag, "timerHistogram",
+		"histogram bounds for matching timers, as <PATTERN>=<BOUND>,... "+
+			"(may be repeated)")
+	flag.Var(&tagFormatFlag, "tagFormat",
+		"how tags are rendered in graphite paths (graphite or path)")
+	flag.Var(&graphiteProtocolFlag, "graphiteProtocol",
+		"protocol for sending reports to graphite (plaintext or pickle)")
+	flag.Var(&graphiteRoutingFlag, "graphiteRouting",
+		"how stats are routed to several graphite destinations "+
+			"(replicate or consistent-hashing)")
+	flag.Var(&prometheusMappingsFlag, "prometheusMapping",
+		"name for matching stats in /metrics, as "+
+			"<PATTERN>=<NAME>[,<LABEL>=<VALUE>...] (may be repeated)")
+	flag.Var(&influxMappingsFlag, "influxMapping",
+		"measurement for matching stats written to influxdb, as "+
+			"<PATTERN>=<MEASUREMENT>[,<TAG>=<VALUE>...] (may be repeated)")
+	flag.Var(&openTSDBMappingsFlag, "opentsdbMapping",
+		"metric and tags for matching stats sent to opentsdb, as "+
+			"<PATTERN>=<METRIC>[,<TAG>=<VALUE>...] (may be repeated)")
+}
+
 var graphiteFlag = flag.String("graphite", "",
-	"address of graphite (carbon) server")
+	"comma-separated addresses of graphite (carbon) servers, as "+
+		"<HOST>:<PORT>[:<INSTANCE>]")
+
+var graphiteDialTimeoutFlag = flag.Duration("graphiteDialTimeout",
+	tally.DEFAULT_GRAPHITE_DIAL_TIMEOUT,
+	"time allowed for connecting to graphite")
+
+var graphiteWriteTimeoutFlag = flag.Duration("graphiteWriteTimeout",
+	tally.DEFAULT_GRAPHITE_WRITE_TIMEOUT,
+	"time allowed for each write to graphite before reconnecting")
+
+var pickleBatchSizeFlag = flag.Int("pickleBatchSize",
+	tally.DEFAULT_PICKLE_BATCH_SIZE,
+	"most stats in each message sent with -graphiteProtocol=pickle")
+
+var prometheusFlag = flag.Bool("prometheus", false,
+	"serve stats to prometheus at /metrics on the status port")
+
+var prometheusExpiryFlag = flag.Int("prometheusExpiry",
+	tally.DEFAULT_PROMETHEUS_EXPIRY,
+	"flushes after which a stat that isn't updated is removed from /metrics")
+
+var influxdbFlag = flag.String("influxdb", "",
+	"influxdb write url to send stats to, e.g. "+
+		"http://localhost:8086/write?db=stats or udp://localhost:8089")
+
+var influxBatchSizeFlag = flag.Int("influxBatchSize",
+	tally.DEFAULT_INFLUX_BATCH_SIZE,
+	"most lines in each request to influxdb")
+
+var influxGzipFlag = flag.Bool("influxGzip", true,
+	"compress requests to influxdb with gzip")
+
+var influxRetriesFlag = flag.Int("influxRetries", tally.DEFAULT_INFLUX_RETRIES,
+	"times to retry a failed request to influxdb")
+
+var openTSDBFlag = flag.String("opentsdb", "",
+	"opentsdb url to send stats to, e.g. tcp://localhost:4242 (telnet) "+
+		"or http://localhost:4242 (/api/put)")
+
+var openTSDBBatchSizeFlag = flag.Int("opentsdbBatchSize",
+	tally.DEFAULT_OPENTSDB_BATCH_SIZE,
+	"most data points in each request or write to opentsdb")
+
+var openTSDBHostFlag = flag.String("opentsdbHost", "",
+	"host tag for stats sent to opentsdb without one (default: hostname)")
+
+var openTSDBRetriesFlag = flag.Int("opentsdbRetries",
+	tally.DEFAULT_OPENTSDB_RETRIES,
+	"times to retry a failed request or write to opentsdb")
+
+var repeatFlag = flag.String("repeat", "",
+	"comma-separated upstream statsd servers to forward samples to, as "+
+		"udp://<HOST>:<PORT> or tcp://<HOST>:<PORT>")
+
+var repeatMTUFlag = flag.Int("repeatMTU", tally.DEFAULT_REPEATER_MTU,
+	"most bytes in each datagram forwarded with -repeat")
+
+var repeatOnlyFlag = flag.Bool("repeatOnly", false,
+	"forward samples with -repeat without aggregating them locally")
 
 var haroldFlag = flag.String("harold", "",
 	"base url of harold service (REQUIRES -haroldSecret)")
@@ -41,6 +192,128 @@ var haroldSecretFlag = flag.String("haroldSecret", "",
 var logtoFlag = flag.String("logto", "stdout",
 	"destination for logging (one of: stdout, stderr, syslog)")
 
+var logDestinations = map[string]func(){
+	"stdout": func() { tally.LogTo(os.Stdout) },
+	"stderr": func() { tally.LogTo(os.Stderr) },
+	"syslog": tally.LogToSyslog,
+}
+
+// reloadableFlags lists the flags whose changes are applied on SIGHUP. Changes
+// to other flags only take effect on restart.
+var reloadableFlags = map[string]bool{
+	"graphite":             true,
+	"graphiteDialTimeout":  true,
+	"graphiteWriteTimeout": true,
+	"graphiteProtocol":     true,
+	"graphiteRouting":      true,
+	"pickleBatchSize":      true,
+	"harold":               true,
+	"haroldSecret":         true,
+	"flushInterval":        true,
+	"timerPercentiles":     true,
+	"tagFormat":            true,
+	"logto":                true,
+	"shutdownTimeout":      true,
+}
+
+func newGraphite(address string,
+	options ...interface{}) (*tally.Graphite, error) {
+	if address == "" {
+		return nil, errors.New("-graphite is required")
+	}
+	return tally.NewGraphite(address, options...)
+}
+
+func newHarold(address, secret string) (*tally.Harold, error) {
+	if address == "" {
+		return nil, nil
+	}
+	if secret == "" {
+		return nil, errors.New("harold requires -haroldSecret to be set")
+	}
+	return tally.NewHarold(address, secret)
+}
+
+// reload parses the command line and config file again, and applies any
+// changes to reloadable flags to the running server.
+func reload(server *tally.Server) {
+	status := tally.ReloadStatus{Time: time.Now()}
+	if err := reloadFlags(server, &status); err != nil {
+		status.Error = err.Error()
+	}
+	server.SetReloadStatus(status)
+}
+
+func reloadFlags(server *tally.Server, status *tally.ReloadStatus) error {
+	flags := tally.CopyFlagSet(flag.CommandLine)
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	if *configFlag != "" {
+		if _, err := tally.ReadFlagFile(*configFlag, flags); err != nil {
+			return err
+		}
+	}
+
+	var changed, restart []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() == flag.Lookup(f.Name).Value.String() {
+			return
+		}
+		if reloadableFlags[f.Name] {
+			changed = append(changed, f.Name)
+		} else {
+			restart = append(restart, f.Name)
+		}
+	})
+	status.RequiresRestart = restart
+
+	value := func(name string) flag.Value {
+		return flags.Lookup(name).Value
+	}
+	setLogging, ok := logDestinations[value("logto").String()]
+	if !ok {
+		return errors.New("-logto must be one of stdout, stderr, or syslog")
+	}
+	graphite, err := newGraphite(value("graphite").String(),
+		tally.DialTimeout(
+			value("graphiteDialTimeout").(flag.Getter).Get().(time.Duration)),
+		tally.WriteTimeout(
+			value("graphiteWriteTimeout").(flag.Getter).Get().(time.Duration)),
+		*value("graphiteProtocol").(*tally.GraphiteProtocol),
+		*value("graphiteRouting").(*tally.GraphiteRouting),
+		tally.PickleBatchSize(
+			value("pickleBatchSize").(flag.Getter).Get().(int)))
+	if err != nil {
+		return err
+	}
+	harold, err := newHarold(value("harold").String(),
+		value("haroldSecret").String())
+	if err != nil {
+		return err
+	}
+	err = server.Reload(
+		value("flushInterval").(flag.Getter).Get().(time.Duration),
+		graphite, harold,
+		*value("timerPercentiles").(*tally.TimerPercentiles),
+		*value("tagFormat").(*tally.TagFormat),
+		tally.ShutdownTimeout(
+			value("shutdownTimeout").(flag.Getter).Get().(time.Duration)))
+	if err != nil {
+		return err
+	}
+	if value("logto").String() != *logtoFlag {
+		setLogging()
+	}
+
+	// later reloads are compared with the settings now in effect
+	for _, name := range changed {
+		flag.Set(name, value(name).String())
+	}
+	status.Applied = changed
+	return nil
+}
+
 func main() {
 	flag.Parse()
 	if *configFlag != "" {
@@ -51,45 +324,130 @@ func main() {
 		}
 	}
 
-	switch *logtoFlag {
-	case "stdout":
-		tally.LogTo(os.Stdout)
-	case "stderr":
-		tally.LogTo(os.Stderr)
-	case "syslog":
-		tally.LogToSyslog()
-	default:
+	setLogging, ok := logDestinations[*logtoFlag]
+	if !ok {
 		fmt.Fprintf(os.Stderr,
 			"error: -logto must be one of stdout, stderr, or syslog\n")
 		os.Exit(2)
 	}
+	setLogging()
 
-	if *graphiteFlag == "" {
-		fmt.Fprintf(os.Stderr, "-graphite is required\n")
+	if err := tally.SetTimerAccuracy(*timerAccuracyFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "error: -timerAccuracy: %s\n", err)
 		os.Exit(2)
 	}
-	graphite, err := tally.NewGraphite(*graphiteFlag)
+
+	tally.SetTimerHistograms(timerHistogramsFlag)
+
+	graphite, err := newGraphite(*graphiteFlag,
+		tally.DialTimeout(*graphiteDialTimeoutFlag),
+		tally.WriteTimeout(*graphiteWriteTimeoutFlag), graphiteProtocolFlag,
+		tally.PickleBatchSize(*pickleBatchSizeFlag), graphiteRoutingFlag)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
-		os.Exit(1)
+		os.Exit(2)
 	}
 
-	var harold *tally.Harold
-	if *haroldFlag != "" {
-		if *haroldSecretFlag == "" {
-			fmt.Fprintf(os.Stderr, "harold requires -haroldSecret to be set\n")
+	harold, err := newHarold(*haroldFlag, *haroldSecretFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(2)
+	}
+
+	unixSocketMode, err := strconv.ParseUint(*unixSocketModeFlag, 8, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: -unixSocketMode must be octal\n")
+		os.Exit(2)
+	}
+	unixSockets := tally.UnixSockets{
+		DatagramPath: *unixDatagramFlag,
+		StreamPath:   *unixStreamFlag,
+		Mode:         os.FileMode(unixSocketMode),
+		Owner:        *unixSocketOwnerFlag,
+		Group:        *unixSocketGroupFlag,
+	}
+
+	options := []interface{}{
+		timerPercentilesFlag, tagFormatFlag,
+		tally.TCPListener{Port: *tcpPortFlag}, unixSockets,
+		tally.ReusePort(*reusePortFlag),
+		tally.ReceiveBuffer(*receiveBufferFlag),
+		tally.ShutdownTimeout(*shutdownTimeoutFlag),
+		tally.ReportQueueSize(*reportQueueSizeFlag),
+		tally.ReportSpool{Dir: *spoolDirFlag, MaxBytes: *spoolMaxBytesFlag},
+	}
+	if *prometheusFlag {
+		prom, err := tally.NewPrometheus(prometheusMappingsFlag,
+			tally.PrometheusExpiry(*prometheusExpiryFlag))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: -prometheus: %s\n", err)
 			os.Exit(2)
 		}
-		harold, err = tally.NewHarold(*haroldFlag, *haroldSecretFlag)
+		options = append(options, prom)
+	}
+	if *influxdbFlag != "" {
+		influx, err := tally.NewInfluxDB(*influxdbFlag, influxMappingsFlag,
+			tally.InfluxBatchSize(*influxBatchSizeFlag),
+			tally.InfluxGzip(*influxGzipFlag),
+			tally.InfluxRetries(*influxRetriesFlag))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: %s\n", err)
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "error: -influxdb: %s\n", err)
+			os.Exit(2)
 		}
+		options = append(options, influx)
 	}
-
-	server := tally.NewServer(
+	if *openTSDBFlag != "" {
+		host := *openTSDBHostFlag
+		if host == "" {
+			host, _ = os.Hostname()
+		}
+		tsdb, err := tally.NewOpenTSDB(*openTSDBFlag, openTSDBMappingsFlag,
+			tally.OpenTSDBBatchSize(*openTSDBBatchSizeFlag),
+			tally.OpenTSDBHostTag(host),
+			tally.OpenTSDBRetries(*openTSDBRetriesFlag))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: -opentsdb: %s\n", err)
+			os.Exit(2)
+		}
+		options = append(options, tsdb)
+	}
+	if *repeatFlag != "" {
+		repeater, err := tally.NewRepeater(*repeatFlag,
+			tally.RepeaterMTU(*repeatMTUFlag),
+			tally.RepeatOnly(*repeatOnlyFlag))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: -repeat: %s\n", err)
+			os.Exit(2)
+		}
+		options = append(options, repeater)
+	}
+	server, err := tally.NewServer(
 		*interfaceFlag, *portFlag, *numWorkersFlag, *flushIntervalFlag,
-		graphite, harold)
+		graphite, harold, options...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	// stop gracefully on the first signal, and immediately on the second
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "received %s, stopping\n", sig)
+		server.Stop()
+		sig = <-signals
+		fmt.Fprintf(os.Stderr, "received %s, exiting\n", sig)
+		os.Exit(1)
+	}()
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for _ = range hangups {
+			reload(server)
+		}
+	}()
 
 	err = server.Loop()
 	if err != nil {
@@ -0,0 +1,196 @@
+package tally
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Backend is a destination for the stats of each flushed snapshot. Backends
+// are flushed concurrently, and the snapshot is reused once they've all
+// returned, so Flush must not keep the view, and should buffer anything that
+// may take long to deliver.
+type Backend interface {
+	// Name identifies the backend in logs, internal stats and the status
+	// page. It must be unique among a server's backends.
+	Name() string
+	// Flush delivers the stats of a snapshot.
+	Flush(snapshot SnapshotView) error
+	// Status describes the state of the backend for the status page.
+	Status() string
+	// Close releases the backend's resources once it's no longer used.
+	Close() error
+}
+
+// HTTPBackend is a backend whose stats are served by the status server at the
+// given path, rather than sent anywhere.
+type HTTPBackend interface {
+	Backend
+	http.Handler
+	Path() string
+}
+
+// SnapshotView is a read-only view of a snapshot, as given to backends.
+type SnapshotView interface {
+	// Start is when the snapshot's interval began.
+	Start() time.Time
+	// Duration is the length of the snapshot's interval.
+	Duration() time.Duration
+	// TimerPercentiles lists the percentiles to report for each timer.
+	TimerPercentiles() TimerPercentiles
+	// StatPath renders the graphite path for a stat, placing the key's tags
+	// (if any) according to the configured tag format.
+	StatPath(prefix, key, suffix string) string
+	NumStats() int
+	EachCount(f func(key string, value float64))
+	EachGauge(f func(key string, value float64))
+	EachSet(f func(key string, count float64))
+	// EachTimer calls f for the timers that have received samples.
+	EachTimer(f func(key string, timer TimerView))
+	EachReport(f func(key string, value float64, timestamp time.Time))
+	// EachStringCount calls f for each value of each string counted during
+	// the interval.
+	EachStringCount(f func(key, value string, count float64))
+}
+
+// TimerView is a read-only view of a timer.
+type TimerView interface {
+	Count() float64
+	ScaledCount() float64
+	Sum() float64
+	ScaledSum() float64
+	Min() float64
+	Max() float64
+	Mean() float64
+	StdDev() float64
+	Quantile(q float64) float64
+	Lower(q float64) (count, sum float64)
+	// Histogram returns the timer's histogram bounds and the cumulative count
+	// of samples up to each, or nil if it has no histogram.
+	Histogram() (bounds, cumulative []float64)
+}
+
+type registeredBackend struct {
+	backend   Backend
+	successes int64         // since last taken by AddInternalStats
+	failures  int64         // since last taken by AddInternalStats
+	latency   time.Duration // of the last flush
+}
+
+// BackendRegistry holds the backends a server flushes its snapshots to.
+type BackendRegistry struct {
+	mu       sync.Mutex
+	backends []*registeredBackend
+}
+
+func NewBackendRegistry() *BackendRegistry {
+	return new(BackendRegistry)
+}
+
+// Register adds a backend, which must not have the same name as another.
+func (registry *BackendRegistry) Register(backend Backend) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, registered := range registry.backends {
+		if registered.backend.Name() == backend.Name() {
+			return errors.New(fmt.Sprintf(
+				"backend %s is already registered", backend.Name()))
+		}
+	}
+	registry.backends = append(registry.backends,
+		&registeredBackend{backend: backend})
+	return nil
+}
+
+// Unregister removes a backend by name, returning it, or nil if there's no
+// such backend. It isn't closed.
+func (registry *BackendRegistry) Unregister(name string) Backend {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for i, registered := range registry.backends {
+		if registered.backend.Name() == name {
+			registry.backends = append(registry.backends[:i],
+				registry.backends[i+1:]...)
+			return registered.backend
+		}
+	}
+	return nil
+}
+
+// Backends returns the registered backends, in the order they were added.
+func (registry *BackendRegistry) Backends() []Backend {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	backends := make([]Backend, len(registry.backends))
+	for i, registered := range registry.backends {
+		backends[i] = registered.backend
+	}
+	return backends
+}
+
+// Flush flushes a snapshot to every backend at once, returning when they've
+// all finished. A backend's failure doesn't affect the others.
+func (registry *BackendRegistry) Flush(snapshot SnapshotView) {
+	registry.mu.Lock()
+	backends := append([]*registeredBackend(nil), registry.backends...)
+	registry.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, registered := range backends {
+		wg.Add(1)
+		go func(registered *registeredBackend) {
+			defer wg.Done()
+			start := time.Now()
+			err := registered.backend.Flush(snapshot)
+			latency := time.Since(start)
+			if err != nil {
+				errorlog("failed to flush to %s: %s",
+					registered.backend.Name(), err)
+			}
+			registry.mu.Lock()
+			defer registry.mu.Unlock()
+			if err != nil {
+				registered.failures++
+			} else {
+				registered.successes++
+			}
+			registered.latency = latency
+		}(registered)
+	}
+	wg.Wait()
+}
+
+// Statuses returns the status of each backend, by name.
+func (registry *BackendRegistry) Statuses() map[string]string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	statuses := make(map[string]string)
+	for _, registered := range registry.backends {
+		statuses[registered.backend.Name()] = registered.backend.Status()
+	}
+	return statuses
+}
+
+// AddInternalStats adds the flushes to each backend that have succeeded and
+// failed since the last call, and the latency of its last flush in seconds.
+func (registry *BackendRegistry) AddInternalStats(snapshot *Snapshot) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, registered := range registry.backends {
+		prefix := "tallier.backend." + registered.backend.Name()
+		snapshot.Count(prefix+".successes", float64(registered.successes))
+		snapshot.Count(prefix+".failures", float64(registered.failures))
+		snapshot.Report(prefix+".latency", registered.latency.Seconds())
+		registered.successes, registered.failures = 0, 0
+	}
+}
+
+// Close closes every backend.
+func (registry *BackendRegistry) Close() {
+	for _, backend := range registry.Backends() {
+		if err := backend.Close(); err != nil {
+			errorlog("failed to close %s: %s", backend.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package tally
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testBackend records the counts of each snapshot flushed to it.
+type testBackend struct {
+	name    string
+	fail    bool
+	block   chan struct{} // if not nil, Flush waits for it to be closed
+	done    chan struct{} // if not nil, signalled after each flush
+	flushed []map[string]float64
+	closed  bool
+}
+
+func (backend *testBackend) Name() string {
+	return backend.name
+}
+
+func (backend *testBackend) Flush(snapshot SnapshotView) error {
+	if backend.block != nil {
+		<-backend.block
+	}
+	counts := make(map[string]float64)
+	snapshot.EachCount(func(key string, value float64) {
+		counts[key] = value
+	})
+	backend.flushed = append(backend.flushed, counts)
+	if backend.done != nil {
+		backend.done <- struct{}{}
+	}
+	if backend.fail {
+		return errors.New("this backend always fails")
+	}
+	return nil
+}
+
+func (backend *testBackend) Status() string {
+	return "testing"
+}
+
+func (backend *testBackend) Close() error {
+	backend.closed = true
+	return nil
+}
+
+func TestBackendRegistry(t *testing.T) {
+	registry := NewBackendRegistry()
+	a := &testBackend{name: "a"}
+	b := &testBackend{name: "b", fail: true}
+	for _, backend := range []Backend{a, b} {
+		if err := registry.Register(backend); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.Register(&testBackend{name: "a"}); err == nil {
+		t.Error("expected error registering a duplicate name")
+	}
+
+	snapshot := NewSnapshot()
+	snapshot.Count("x", 1)
+	registry.Flush(snapshot)
+	expected := []map[string]float64{{"x": 1}}
+	for _, backend := range []*testBackend{a, b} {
+		if s, ok := assertDeepEqual(expected, backend.flushed); !ok {
+			t.Errorf("%s:%s", backend.name, s)
+		}
+	}
+
+	stats := NewSnapshot()
+	registry.AddInternalStats(stats)
+	result := map[string]float64{
+		"a.successes": stats.counts["tallier.backend.a.successes"],
+		"a.failures":  stats.counts["tallier.backend.a.failures"],
+		"b.successes": stats.counts["tallier.backend.b.successes"],
+		"b.failures":  stats.counts["tallier.backend.b.failures"],
+	}
+	expectedStats := map[string]float64{
+		"a.successes": 1, "a.failures": 0, "b.successes": 0, "b.failures": 1,
+	}
+	if s, ok := assertDeepEqual(expectedStats, result); !ok {
+		t.Error(s)
+	}
+	if _, ok := stats.reports["tallier.backend.a.latency"]; !ok {
+		t.Error("expected latency to be reported")
+	}
+
+	if registry.Unregister("b") != b {
+		t.Error("expected b to be unregistered")
+	}
+	registry.Close()
+	if !a.closed || b.closed {
+		t.Errorf("expected only a to be closed, got %v, %v",
+			a.closed, b.closed)
+	}
+}
+
+func TestBackendRegistryConcurrent(t *testing.T) {
+	registry := NewBackendRegistry()
+	slow := &testBackend{name: "slow", block: make(chan struct{})}
+	fast := &testBackend{name: "fast", done: make(chan struct{})}
+	registry.Register(slow)
+	registry.Register(fast)
+	done := make(chan struct{})
+	go func() {
+		registry.Flush(NewSnapshot())
+		close(done)
+	}()
+	select {
+	case <-fast.done:
+	case <-time.After(time.Second):
+		t.Fatal("a slow backend held up the others")
+	}
+	select {
+	case <-done:
+		t.Fatal("flush returned before every backend finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(slow.block)
+	<-done
+}
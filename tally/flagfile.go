@@ -7,7 +7,9 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
 	"strings"
 )
 
@@ -33,12 +35,20 @@ func (e *SyntaxError) Error() string {
 	return fmt.Sprintf("%s%d: %s", prefix, e.line, e.msg)
 }
 
+// NewFlagFile reads flags from a file, setting them on the command line flag
+// set.
 func NewFlagFile(path string) (ff *FlagFile, err error) {
+	return ReadFlagFile(path, flag.CommandLine)
+}
+
+// ReadFlagFile reads flags from a file, setting them on the given flag set.
+func ReadFlagFile(path string, flags *flag.FlagSet) (ff *FlagFile, err error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return
 	}
-	ff = &FlagFile{flag.NewFlagSet(os.Args[0], flag.ExitOnError)}
+	defer file.Close()
+	ff = &FlagFile{flags}
 	err = ff.ReadFlags(file)
 	synerr, ok := err.(*SyntaxError)
 	if ok {
@@ -100,7 +110,7 @@ func (ff *FlagFile) ReadFlags(reader io.Reader) error {
 			}
 			return &SyntaxError{err.Error(), "", lineNo}
 		}
-		flag := flag.Lookup(name)
+		flag := ff.Lookup(name)
 		if flag == nil {
 			return &SyntaxError{
 				fmt.Sprintf("undefined flag: %s", name),
@@ -114,3 +124,19 @@ func (ff *FlagFile) ReadFlags(reader io.Reader) error {
 	}
 	return nil
 }
+
+// CopyFlagSet returns a new flag set defining the same flags as the given one,
+// with their default values. Flags can be parsed into the copy without
+// affecting the values of the original flags.
+func CopyFlagSet(flags *flag.FlagSet) *flag.FlagSet {
+	copied := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+	copied.SetOutput(ioutil.Discard)
+	flags.VisitAll(func(f *flag.Flag) {
+		value := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface()
+		copied.Var(value.(flag.Value), f.Name, f.Usage)
+		if f.DefValue != "" {
+			copied.Set(f.Name, f.DefValue)
+		}
+	})
+	return copied
+}
@@ -3,8 +3,11 @@ package tally
 import (
 	"bufio"
 	"bytes"
+	"flag"
 	"io"
+	"strings"
 	"testing"
+	"time"
 )
 
 type TestLineReader [][]byte
@@ -85,3 +88,34 @@ func TestReadArg(t *testing.T) {
 		t.Errorf("expected io.EOF, got %v", err)
 	}
 }
+
+func TestCopyFlagSet(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	interval := flags.Duration("interval", time.Second, "")
+	percentiles := TimerPercentiles{90}
+	flags.Var(&percentiles, "percentiles", "")
+	flags.Parse([]string{"-interval", "5s", "-percentiles", "50"})
+
+	copied := CopyFlagSet(flags)
+	if v := copied.Lookup("interval").Value.String(); v != "1s" {
+		t.Errorf("expected copied flag to have default value 1s, got %s", v)
+	}
+	if v := copied.Lookup("percentiles").Value.String(); v != "90" {
+		t.Errorf("expected copied flag to have default value 90, got %s", v)
+	}
+	ff := &FlagFile{copied}
+	err := ff.ReadFlags(strings.NewReader("percentiles = 99\n"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if v := copied.Lookup("percentiles").Value.String(); v != "99" {
+		t.Errorf("expected percentiles 99, got %s", v)
+	}
+	if *interval != 5*time.Second || percentiles.String() != "50" {
+		t.Errorf("original flags were changed: %s, %s", *interval,
+			percentiles.String())
+	}
+	if err = ff.ReadFlags(strings.NewReader("bogus = 1\n")); err == nil {
+		t.Error("expected an error for an undefined flag")
+	}
+}
@@ -1,52 +1,479 @@
 package tally
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_GRAPHITE_DIAL_TIMEOUT  = 5 * time.Second
+	DEFAULT_GRAPHITE_WRITE_TIMEOUT = 10 * time.Second
+	// GRAPHITE_CHUNK_SIZE is the most bytes written to graphite at once, each
+	// write having its own deadline.
+	GRAPHITE_CHUNK_SIZE = 64 * 1024
 )
 
 type GraphiteDialer interface {
 	Dial(*net.TCPAddr) (io.WriteCloser, error)
 }
 
-// Graphite is a client for sending stat reports to a graphite (carbon) server.
+// DialTimeout is a graphite option bounding the time taken to connect.
+type DialTimeout time.Duration
+
+// WriteTimeout is a graphite option bounding the time taken by each write of
+// up to GRAPHITE_CHUNK_SIZE bytes.
+type WriteTimeout time.Duration
+
+// GraphiteRouting is a graphite option selecting how stats are routed when
+// there are several destinations.
+type GraphiteRouting int
+
+const (
+	// ROUTE_REPLICATE sends every stat to every destination.
+	ROUTE_REPLICATE GraphiteRouting = iota
+	// ROUTE_CONSISTENT_HASHING sends each stat to one destination, chosen by
+	// its path as carbon-relay's consistent-hashing method would.
+	ROUTE_CONSISTENT_HASHING
+)
+
+var graphiteRoutingNames = []string{"replicate", "consistent-hashing"}
+
+func (routing *GraphiteRouting) String() string {
+	return graphiteRoutingNames[*routing]
+}
+
+func (routing *GraphiteRouting) Set(value string) error {
+	for i, name := range graphiteRoutingNames {
+		if value == name {
+			*routing = GraphiteRouting(i)
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("graphite routing must be one of: %s",
+		strings.Join(graphiteRoutingNames, ", ")))
+}
+
+// Graphite is a client for sending stat reports to one or more graphite
+// (carbon) servers. It keeps its connections open between reports,
+// reconnecting after an error.
 type Graphite struct {
-	addr   *net.TCPAddr
-	dialer GraphiteDialer
+	destinations []*graphiteDestination
+	routing      GraphiteRouting
+	ring         *hashRing
+	dialer       GraphiteDialer
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	protocol     GraphiteProtocol
+	batchSize    int
+}
+
+type graphiteDestination struct {
+	name string // as configured, e.g. "host:port:instance"
+	addr *net.TCPAddr
+
+	mu   sync.Mutex // held while sending
+	conn io.WriteCloser
 }
 
 func (graphite *Graphite) Dial(addr *net.TCPAddr) (io.WriteCloser, error) {
-	return net.DialTCP("tcp", nil, addr)
+	return net.DialTimeout("tcp", addr.String(), graphite.dialTimeout)
 }
 
+// NewGraphite creates a client for a comma-separated list of destinations,
+// each given as host:port or, like carbon-relay's destinations,
+// host:port:instance. The instance name only affects consistent hashing.
 func NewGraphite(address string,
 	options ...interface{}) (client *Graphite, err error) {
-	addr, err := net.ResolveTCPAddr("tcp", address)
-	client = &Graphite{addr, nil}
+	client = &Graphite{
+		dialTimeout:  DEFAULT_GRAPHITE_DIAL_TIMEOUT,
+		writeTimeout: DEFAULT_GRAPHITE_WRITE_TIMEOUT,
+		batchSize:    DEFAULT_PICKLE_BATCH_SIZE,
+	}
 	client.dialer = client
 	for _, option := range options {
 		switch option.(type) {
 		case GraphiteDialer:
 			client.dialer = option.(GraphiteDialer)
+		case DialTimeout:
+			client.dialTimeout = time.Duration(option.(DialTimeout))
+		case WriteTimeout:
+			client.writeTimeout = time.Duration(option.(WriteTimeout))
+		case GraphiteProtocol:
+			client.protocol = option.(GraphiteProtocol)
+		case PickleBatchSize:
+			client.batchSize = int(option.(PickleBatchSize))
+		case GraphiteRouting:
+			client.routing = option.(GraphiteRouting)
 		default:
 			err = errors.New(fmt.Sprintf("invalid graphite option %T", option))
 			return
 		}
 	}
+	var hosts, instances []string
+	for _, destination := range strings.Split(address, ",") {
+		destination = strings.TrimSpace(destination)
+		host, port, instance := splitDestination(destination)
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return client, err
+		}
+		for _, other := range client.destinations {
+			if other.name == destination {
+				return client, errors.New(fmt.Sprintf(
+					"graphite destination %s given twice", destination))
+			}
+		}
+		client.destinations = append(client.destinations,
+			&graphiteDestination{name: destination, addr: addr})
+		hosts = append(hosts, host)
+		instances = append(instances, instance)
+	}
+	if client.routing == ROUTE_CONSISTENT_HASHING {
+		client.ring = newHashRing(hosts, instances)
+	}
 	return
 }
 
+// sameSettings returns whether two clients were created with the same
+// destinations and options, so that one can stand in for the other. Either may
+// be nil.
+func (graphite *Graphite) sameSettings(other *Graphite) bool {
+	if graphite == nil || other == nil {
+		return graphite == other
+	}
+	if len(graphite.destinations) != len(other.destinations) {
+		return false
+	}
+	for i, destination := range graphite.destinations {
+		if destination.name != other.destinations[i].name ||
+			destination.addr.String() != other.destinations[i].addr.String() {
+			return false
+		}
+	}
+	return graphite.customDialer() == other.customDialer() &&
+		graphite.routing == other.routing &&
+		graphite.protocol == other.protocol &&
+		graphite.dialTimeout == other.dialTimeout &&
+		graphite.writeTimeout == other.writeTimeout &&
+		graphite.batchSize == other.batchSize
+}
+
+// customDialer returns the dialer given as an option, or nil if the client
+// dials for itself.
+func (graphite *Graphite) customDialer() GraphiteDialer {
+	if graphite.dialer == GraphiteDialer(graphite) {
+		return nil
+	}
+	return graphite.dialer
+}
+
+// splitDestination splits a destination of the form host:port[:instance],
+// where the host may be a bracketed IPv6 address.
+func splitDestination(destination string) (host, port, instance string) {
+	rest := destination
+	if strings.HasPrefix(rest, "[") {
+		if end := strings.Index(rest, "]"); end > 0 {
+			host, rest = rest[1:end], strings.TrimPrefix(rest[end+1:], ":")
+			port = rest
+			if i := strings.Index(rest, ":"); i >= 0 {
+				port, instance = rest[:i], rest[i+1:]
+			}
+			return
+		}
+	}
+	parts := strings.SplitN(rest, ":", 3)
+	host = parts[0]
+	if len(parts) > 1 {
+		port = parts[1]
+	}
+	if len(parts) > 2 {
+		instance = parts[2]
+	}
+	return
+}
+
+func (graphite *Graphite) Name() string {
+	return "graphite"
+}
+
+// Flush sends a snapshot's stats to graphite straight away.
+func (graphite *Graphite) Flush(snapshot SnapshotView) error {
+	return graphite.SendReport(snapshot)
+}
+
+func (graphite *Graphite) Status() string {
+	addrs := make([]string, len(graphite.destinations))
+	for i, destination := range graphite.destinations {
+		addrs[i] = destination.addr.String()
+	}
+	status := fmt.Sprintf("sending to %s with the %s protocol",
+		strings.Join(addrs, ", "), graphiteProtocolNames[graphite.protocol])
+	if len(addrs) > 1 {
+		status += ", routing by " + graphiteRoutingNames[graphite.routing]
+	}
+	return status
+}
+
 // SendReport takes a snapshot and submits all its stats to graphite.
-func (graphite *Graphite) SendReport(snapshot *Snapshot) (err error) {
-	conn, err := graphite.dialer.Dial(graphite.addr)
+func (graphite *Graphite) SendReport(snapshot SnapshotView) error {
+	if graphite.protocol == GRAPHITE_PICKLE || len(graphite.destinations) > 1 {
+		return graphite.Send(RenderReport(snapshot))
+	}
+	return graphite.send(graphite.destinations[0], func(w io.Writer) error {
+		buffered := bufio.NewWriterSize(w, GRAPHITE_CHUNK_SIZE)
+		for _, line := range GraphiteReport(snapshot) {
+			if _, err := buffered.WriteString(line); err != nil {
+				return err
+			}
+		}
+		return buffered.Flush()
+	})
+}
+
+// Send submits a report rendered by RenderReport to graphite, converting it
+// to the pickle protocol if that's selected. Reports are sent to all the
+// destinations at once, and an error is returned if any of them fails, in
+// which case the whole report should be sent again; graphite keeps the last
+// value received for a timestamp, so the repetition does no harm. A
+// ReportQueue avoids the repetition by queueing each destination's share of a
+// report separately.
+func (graphite *Graphite) Send(report []byte) error {
+	if len(graphite.destinations) == 1 {
+		return graphite.sendTo(graphite.destinations[0], report)
+	}
+	shards := graphite.split(report)
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, shard []byte) {
+			defer wg.Done()
+			errs[i] = graphite.sendTo(graphite.destinations[i], shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s",
+				graphite.destinations[i].addr, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// split divides a rendered report between the destinations, returning the
+// share of each by index. With consistent hashing each line goes to one
+// destination, whose share may be empty; otherwise every destination has the
+// whole report.
+func (graphite *Graphite) split(report []byte) [][]byte {
+	shards := make([][]byte, len(graphite.destinations))
+	if graphite.routing != ROUTE_CONSISTENT_HASHING || len(shards) == 1 {
+		for i := range shards {
+			shards[i] = report
+		}
+		return shards
+	}
+	for len(report) > 0 {
+		line := report
+		if i := bytes.IndexByte(report, '\n'); i >= 0 {
+			line, report = report[:i+1], report[i+1:]
+		} else {
+			report = nil
+		}
+		path := line
+		if i := bytes.IndexByte(line, ' '); i >= 0 {
+			path = line[:i]
+		}
+		node := graphite.ring.node(string(path))
+		shards[node] = append(shards[node], line...)
+	}
+	return shards
+}
+
+// sendTo submits a rendered report to one destination.
+func (graphite *Graphite) sendTo(destination *graphiteDestination,
+	report []byte) error {
+	return graphite.send(destination, func(w io.Writer) error {
+		if graphite.protocol == GRAPHITE_PICKLE {
+			return writePickled(w, report, graphite.batchSize)
+		}
+		for len(report) > 0 {
+			chunk := report
+			if len(chunk) > GRAPHITE_CHUNK_SIZE {
+				chunk = chunk[:GRAPHITE_CHUNK_SIZE]
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			report = report[len(chunk):]
+		}
+		return nil
+	})
+}
+
+// send connects to a destination if necessary, and calls write to write a
+// report to the connection. The connection is closed if anything goes wrong,
+// so that the next report is sent on a new one.
+func (graphite *Graphite) send(destination *graphiteDestination,
+	write func(io.Writer) error) error {
+	destination.mu.Lock()
+	defer destination.mu.Unlock()
+	if destination.conn != nil && isClosed(destination.conn) {
+		destination.closeLocked()
+	}
+	if destination.conn == nil {
+		conn, err := graphite.dialer.Dial(destination.addr)
+		if err != nil {
+			return err
+		}
+		destination.conn = conn
+	}
+	err := write(deadlineWriter{destination.conn, graphite.writeTimeout})
 	if err != nil {
-		return
+		destination.closeLocked()
 	}
-	defer conn.Close()
-	msg := strings.Join(snapshot.GraphiteReport(), "")
-	_, err = conn.Write([]byte(msg))
+	return err
+}
+
+// Close closes the connections to graphite that are open.
+func (graphite *Graphite) Close() error {
+	for _, destination := range graphite.destinations {
+		destination.mu.Lock()
+		destination.closeLocked()
+		destination.mu.Unlock()
+	}
+	return nil
+}
+
+func (destination *graphiteDestination) closeLocked() {
+	if destination.conn != nil {
+		destination.conn.Close()
+		destination.conn = nil
+	}
+}
+
+// isClosed checks whether the other end has closed a connection that's only
+// written to, since carbon closes idle connections, and writes to a closed
+// connection may appear to succeed. Connections that don't support deadlines
+// are assumed to be open.
+func isClosed(conn io.WriteCloser) bool {
+	netConn, ok := conn.(net.Conn)
+	if !ok {
+		return false
+	}
+	// reads fail without being attempted if the deadline has already passed
+	netConn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	_, err := netConn.Read(b[:])
+	netConn.SetReadDeadline(time.Time{})
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
+// deadlineWriter sets a deadline for each write to a connection, if it
+// supports them.
+type deadlineWriter struct {
+	conn    io.Writer
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(b []byte) (int, error) {
+	if conn, ok := w.conn.(net.Conn); ok && w.timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	return w.conn.Write(b)
+}
+
+// GraphiteReport renders each stat of a snapshot as a line of graphite's
+// plaintext protocol.
+func GraphiteReport(snapshot SnapshotView) (report []string) {
+	timestamp := fmt.Sprintf(" %d\n", snapshot.Start().Unix())
+	makeLine := func(path string, value float64) string {
+		return fmt.Sprintf("%s %f", path, value) + timestamp
+	}
+	percentiles := snapshot.TimerPercentiles()
+	report = make([]string, 0, 2*snapshot.NumStats())
+	seconds := snapshot.Duration().Seconds()
+	counterScale := 1.0 / seconds
+	snapshot.EachCount(func(key string, value float64) {
+		report = append(report, makeLine(
+			snapshot.StatPath("stats.", key, ""), value*counterScale))
+		report = append(report, makeLine(
+			snapshot.StatPath("stats_counts.", key, ""), value))
+	})
+	snapshot.EachTimer(func(key string, timer TimerView) {
+		timerLine := func(stat string, value float64) {
+			report = append(report, makeLine(
+				snapshot.StatPath("stats.timers.", key, "."+stat), value))
+		}
+		timerLine("lower", timer.Min())
+		timerLine("upper", timer.Max())
+		for _, p := range percentiles {
+			suffix := percentileSuffix(p)
+			count, sum := timer.Lower(p / 100)
+			timerLine("upper_"+suffix, timer.Quantile(p/100))
+			timerLine("mean_"+suffix, sum/count)
+			timerLine("sum_"+suffix, sum)
+			timerLine("count_"+suffix, count)
+		}
+		timerLine("mean", timer.Mean())
+		timerLine("median", timer.Quantile(0.5))
+		timerLine("sum", timer.Sum())
+		timerLine("count", timer.ScaledCount())
+		timerLine("count_ps", timer.ScaledCount()/seconds)
+		timerLine("std", timer.StdDev())
+		timerLine("rate", timer.ScaledCount()/seconds)
+		if bounds, cumulative := timer.Histogram(); bounds != nil {
+			for i, count := range cumulative {
+				timerLine("histogram."+binSuffix(bounds[i]), count)
+			}
+			timerLine("histogram.bin_inf", timer.ScaledCount())
+		}
+	})
+	snapshot.EachGauge(func(key string, value float64) {
+		report = append(report, makeLine(
+			snapshot.StatPath("stats.gauges.", key, ""), value))
+	})
+	snapshot.EachSet(func(key string, count float64) {
+		report = append(report, makeLine(
+			snapshot.StatPath("stats.sets.", key, ".count"), count))
+	})
+	snapshot.EachReport(func(key string, value float64, ts time.Time) {
+		report = append(report, fmt.Sprintf("stats.%s %f %d\n", key,
+			value, ts.Unix()))
+	})
 	return
 }
+
+// RenderReport renders all the stats of a snapshot in graphite's plaintext
+// protocol. Reports are queued and spooled in this form whatever protocol
+// they're sent in, so that the protocol can be changed without a restart.
+func RenderReport(snapshot SnapshotView) []byte {
+	lines := GraphiteReport(snapshot)
+	size := 0
+	for _, line := range lines {
+		size += len(line)
+	}
+	var buffer bytes.Buffer
+	buffer.Grow(size)
+	for _, line := range lines {
+		buffer.WriteString(line)
+	}
+	return buffer.Bytes()
+}
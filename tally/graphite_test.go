@@ -6,7 +6,9 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type bufDialer struct{ buffer bytes.Buffer }
@@ -57,9 +59,230 @@ func TestSendReport(t *testing.T) {
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	expected := strings.Join(snapshot.GraphiteReport(), "")
+	expected := strings.Join(GraphiteReport(snapshot), "")
 	sent := dialer.buffer.String()
 	if expected != sent {
 		t.Errorf("  expected:%v\n  but this was sent:\n%v", expected, sent)
 	}
 }
+
+// countingDialer counts dials, failing writes to connections it's told to.
+type countingDialer struct {
+	dials      int
+	failWrites bool
+	buffer     bytes.Buffer
+}
+
+type countingConn struct{ dialer *countingDialer }
+
+func (dialer *countingDialer) Dial(*net.TCPAddr) (io.WriteCloser, error) {
+	dialer.dials++
+	return countingConn{dialer}, nil
+}
+
+func (conn countingConn) Write(b []byte) (int, error) {
+	if conn.dialer.failWrites {
+		return 0, errors.New("this write always fails")
+	}
+	return conn.dialer.buffer.Write(b)
+}
+
+func (countingConn) Close() error {
+	return nil
+}
+
+func TestGraphiteReconnects(t *testing.T) {
+	dialer := new(countingDialer)
+	graphite, _ := NewGraphite("localhost:7", dialer)
+	graphite.Send([]byte("a 1 0\n"))
+	graphite.Send([]byte("b 2 0\n"))
+	if dialer.dials != 1 {
+		t.Errorf("expected the connection to be reused, got %d dials",
+			dialer.dials)
+	}
+	dialer.failWrites = true
+	if err := graphite.Send([]byte("c 3 0\n")); err == nil {
+		t.Error("expected write error")
+	}
+	dialer.failWrites = false
+	graphite.Send([]byte("d 4 0\n"))
+	if dialer.dials != 2 {
+		t.Errorf("expected a new connection after an error, got %d dials",
+			dialer.dials)
+	}
+	if sent := dialer.buffer.String(); sent != "a 1 0\nb 2 0\nd 4 0\n" {
+		t.Errorf("unexpected reports sent: %#v", sent)
+	}
+}
+
+func TestGraphiteClosedByPeer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 100)
+			n, _ := conn.Read(b)
+			// close after each report, as carbon might when idle
+			conn.Close()
+			received <- string(b[:n])
+		}
+	}()
+
+	graphite, _ := NewGraphite(listener.Addr().String())
+	for _, report := range []string{"a 1 0\n", "b 2 0\n"} {
+		if err = graphite.Send([]byte(report)); err != nil {
+			t.Fatal(err)
+		}
+		if r := <-received; r != report {
+			t.Errorf("expected %#v, got %#v", report, r)
+		}
+	}
+}
+
+func TestGraphiteWriteTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// accept, but never read, like a hung relay
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	graphite, _ := NewGraphite(listener.Addr().String(),
+		WriteTimeout(100*time.Millisecond))
+	start := time.Now()
+	err = graphite.Send(make([]byte, 64<<20))
+	if err == nil {
+		t.Error("expected a timeout writing to a hung server")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("write took %s despite timeout", elapsed)
+	}
+}
+
+// addrDialer keeps what's written to each address separately, and fails to
+// connect to the addresses marked down.
+type addrDialer struct {
+	mu      sync.Mutex
+	buffers map[string]*bytes.Buffer
+	down    map[string]bool
+}
+
+type addrConn struct {
+	dialer *addrDialer
+	addr   string
+}
+
+func (dialer *addrDialer) Dial(addr *net.TCPAddr) (io.WriteCloser, error) {
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if dialer.down[addr.String()] {
+		return nil, errors.New("connection refused")
+	}
+	return addrConn{dialer, addr.String()}, nil
+}
+
+func (dialer *addrDialer) setDown(addr string, down bool) {
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if dialer.down == nil {
+		dialer.down = make(map[string]bool)
+	}
+	dialer.down[addr] = down
+}
+
+func (conn addrConn) Write(b []byte) (int, error) {
+	conn.dialer.mu.Lock()
+	defer conn.dialer.mu.Unlock()
+	if conn.dialer.buffers == nil {
+		conn.dialer.buffers = make(map[string]*bytes.Buffer)
+	}
+	if conn.dialer.buffers[conn.addr] == nil {
+		conn.dialer.buffers[conn.addr] = new(bytes.Buffer)
+	}
+	return conn.dialer.buffers[conn.addr].Write(b)
+}
+
+func (addrConn) Close() error {
+	return nil
+}
+
+func (dialer *addrDialer) sent() map[string]string {
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	sent := make(map[string]string)
+	for addr, buffer := range dialer.buffers {
+		sent[addr] = buffer.String()
+	}
+	return sent
+}
+
+func TestGraphiteReplicate(t *testing.T) {
+	dialer := new(addrDialer)
+	graphite, err := NewGraphite("127.0.0.1:2003, 127.0.0.2:2003", dialer)
+	if err == nil {
+		err = graphite.Send([]byte("a 1 0\nb 2 0\n"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"127.0.0.1:2003": "a 1 0\nb 2 0\n",
+		"127.0.0.2:2003": "a 1 0\nb 2 0\n",
+	}
+	if s, ok := assertDeepEqual(expected, dialer.sent()); !ok {
+		t.Error(s)
+	}
+}
+
+func TestGraphiteConsistentHashing(t *testing.T) {
+	dialer := new(addrDialer)
+	graphite, err := NewGraphite(
+		"10.0.0.1:2003:a,10.0.0.2:2004:b,10.0.0.3:2003", dialer,
+		ROUTE_CONSISTENT_HASHING)
+	if err == nil {
+		err = graphite.Send([]byte("stats.x 1 0\nstats.gauges.z 2 0\n" +
+			"tallier.messages.total 3 0\nfoo.bar.baz 4 0\n"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as in TestHashRingMatchesCarbon
+	expected := map[string]string{
+		"10.0.0.1:2003": "stats.gauges.z 2 0\n",
+		"10.0.0.2:2004": "tallier.messages.total 3 0\n",
+		"10.0.0.3:2003": "stats.x 1 0\nfoo.bar.baz 4 0\n",
+	}
+	if s, ok := assertDeepEqual(expected, dialer.sent()); !ok {
+		t.Error(s)
+	}
+}
+
+func TestSplitDestination(t *testing.T) {
+	for destination, expected := range map[string][3]string{
+		"localhost:2003":   {"localhost", "2003", ""},
+		"10.0.0.1:2004:a":  {"10.0.0.1", "2004", "a"},
+		"[::1]:2003":       {"::1", "2003", ""},
+		"[::1]:2003:cache": {"::1", "2003", "cache"},
+	} {
+		host, port, instance := splitDestination(destination)
+		result := [3]string{host, port, instance}
+		if s, ok := assertDeepEqual(expected, result); !ok {
+			t.Errorf("%s:%s", destination, s)
+		}
+	}
+}
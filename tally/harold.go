@@ -60,6 +60,23 @@ func NewHarold(address string, secret string,
 	return
 }
 
+// sameSettings returns whether two clients post to the same service with the
+// same secret. Either may be nil.
+func (harold *Harold) sameSettings(other *Harold) bool {
+	if harold == nil || other == nil {
+		return harold == other
+	}
+	customPoster := func(h *Harold) HaroldPoster {
+		if h.poster == HaroldPoster(h) {
+			return nil
+		}
+		return h.poster
+	}
+	return harold.baseUrl.String() == other.baseUrl.String() &&
+		harold.secret == other.secret &&
+		customPoster(harold) == customPoster(other)
+}
+
 func (harold *Harold) makeUrl(pathParts ...string) string {
 	url := *harold.baseUrl
 	url.Path = path.Join(url.Path, "harold", path.Join(pathParts...))
@@ -97,19 +114,24 @@ func (harold *Harold) Heartbeat(tag string,
 
 // HeartMonitor returns a channel for the caller to send harold heartbeats to.
 // It spins off a goroutine so the heartbeat channel never blocks, even if the
-// harold service is not responding.
+// harold service is not responding. The goroutine exits when the channel is
+// closed.
 func (harold *Harold) HeartMonitor(tag string) (intervals chan time.Duration) {
 	intervals = make(chan time.Duration)
 	go func() {
 		var alive *time.Duration // most recent interval pending to be sent
 		waiting := false         // whether we're waiting on a previous RPC
 
-		// channel for notifying end of asynchronous heartbeat RPC
-		err := make(chan error)
+		// channel for notifying end of asynchronous heartbeat RPC, buffered
+		// so that an RPC can finish after the monitor exits
+		err := make(chan error, 1)
 
 		for {
 			select {
-			case interval := <-intervals:
+			case interval, ok := <-intervals:
+				if !ok {
+					return
+				}
 				alive = &interval
 			case e := <-err:
 				if e != nil {
@@ -0,0 +1,63 @@
+package tally
+
+import (
+	"crypto/md5"
+	"fmt"
+	"sort"
+)
+
+const HASH_RING_REPLICAS = 100
+
+// hashRing is a port of carbon's ConsistentHashRing (with the default
+// carbon_ch hash), so that stats are sharded across carbon-cache nodes just as
+// carbon-relay would shard them.
+type hashRing struct {
+	positions []int // sorted
+	nodes     []int // index of the node at each position
+}
+
+// newHashRing builds a ring of nodes, each identified by its host and carbon
+// instance name, which may be empty.
+func newHashRing(hosts, instances []string) *hashRing {
+	ring := new(hashRing)
+	taken := make(map[int]bool)
+	for node, host := range hosts {
+		instance := "None"
+		if instances[node] != "" {
+			instance = fmt.Sprintf("'%s'", instances[node])
+		}
+		for i := 0; i < HASH_RING_REPLICAS; i++ {
+			// carbon formats the (server, instance) tuple with python's repr
+			position := ringPosition(
+				fmt.Sprintf("('%s', %s):%d", host, instance, i))
+			for taken[position] {
+				position++
+			}
+			taken[position] = true
+			ring.insert(position, node)
+		}
+	}
+	return ring
+}
+
+func (ring *hashRing) insert(position, node int) {
+	i := sort.SearchInts(ring.positions, position)
+	ring.positions = append(ring.positions, 0)
+	copy(ring.positions[i+1:], ring.positions[i:])
+	ring.positions[i] = position
+	ring.nodes = append(ring.nodes, 0)
+	copy(ring.nodes[i+1:], ring.nodes[i:])
+	ring.nodes[i] = node
+}
+
+// node returns the index of the node a key belongs to.
+func (ring *hashRing) node(key string) int {
+	i := sort.SearchInts(ring.positions, ringPosition(key))
+	return ring.nodes[i%len(ring.nodes)]
+}
+
+// ringPosition is the first 16 bits of the key's md5 sum.
+func ringPosition(key string) int {
+	sum := md5.Sum([]byte(key))
+	return int(sum[0])<<8 | int(sum[1])
+}
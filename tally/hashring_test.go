@@ -0,0 +1,24 @@
+package tally
+
+import "testing"
+
+func TestHashRingMatchesCarbon(t *testing.T) {
+	ring := newHashRing([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		[]string{"a", "b", ""})
+	// nodes chosen by carbon's ConsistentHashRing for the same destinations
+	expected := map[string]int{
+		"stats.x":                2,
+		"stats_counts.x":         2,
+		"stats.timers.y.upper":   2,
+		"stats.gauges.z":         0,
+		"foo.bar.baz":            2,
+		"tallier.messages.total": 1,
+	}
+	result := make(map[string]int)
+	for key := range expected {
+		result[key] = ring.node(key)
+	}
+	if s, ok := assertDeepEqual(expected, result); !ok {
+		t.Error(s)
+	}
+}
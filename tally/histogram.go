@@ -0,0 +1,131 @@
+package tally
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HistogramRule assigns bucket boundaries to the timers whose keys match a
+// pattern (as understood by path.Match, e.g. "api.latency.*").
+type HistogramRule struct {
+	pattern string
+	bounds  []float64
+}
+
+// TimerHistograms lists the rules for which timers are reported with
+// histograms. The first rule to match a timer's key applies. It implements
+// flag.Value; each call to Set parses and appends one rule given in the form
+// "<PATTERN>=<BOUND>,<BOUND>,...", so the flag may be repeated.
+type TimerHistograms []HistogramRule
+
+var timerHistograms TimerHistograms
+
+// SetTimerHistograms configures the histogram rules for timers. Like
+// SetTimerAccuracy, this must be called before any timings are collected.
+func SetTimerHistograms(histograms TimerHistograms) {
+	timerHistograms = histograms
+}
+
+func (histograms *TimerHistograms) String() string {
+	rules := make([]string, len(*histograms))
+	for i, rule := range *histograms {
+		bounds := make([]string, len(rule.bounds))
+		for j, bound := range rule.bounds {
+			bounds[j] = strconv.FormatFloat(bound, 'f', -1, 64)
+		}
+		rules[i] = rule.pattern + "=" + strings.Join(bounds, ",")
+	}
+	return strings.Join(rules, " ")
+}
+
+func (histograms *TimerHistograms) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return errors.New("histogram must be given as <PATTERN>=<BOUNDS>")
+	}
+	rule := HistogramRule{pattern: strings.TrimSpace(value[:i])}
+	if _, err := path.Match(rule.pattern, ""); err != nil {
+		return errors.New(fmt.Sprintf("invalid histogram pattern %#v: %s",
+			rule.pattern, err))
+	}
+	for _, field := range strings.Split(value[i+1:], ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid histogram bound %#v", field))
+		}
+		n := len(rule.bounds)
+		if n > 0 && bound <= rule.bounds[n-1] {
+			return errors.New("histogram bounds must be increasing")
+		}
+		rule.bounds = append(rule.bounds, bound)
+	}
+	*histograms = append(*histograms, rule)
+	return nil
+}
+
+// boundsFor returns the bucket boundaries for the given timer key, or nil if
+// it shouldn't have a histogram.
+func (histograms TimerHistograms) boundsFor(key string) []float64 {
+	for _, rule := range histograms {
+		if matched, _ := path.Match(rule.pattern, key); matched {
+			return rule.bounds
+		}
+	}
+	return nil
+}
+
+// TimerHistogram counts timings in buckets with fixed upper bounds. Unlike
+// percentiles, the counts can be meaningfully summed across hosts.
+type TimerHistogram struct {
+	bounds []float64
+	counts []float64 // counts[i] is the number of timings in (bounds[i-1], bounds[i]]
+}
+
+func NewTimerHistogram(bounds []float64) *TimerHistogram {
+	return &TimerHistogram{bounds, make([]float64, len(bounds))}
+}
+
+// Add counts a timing, weighted by the inverse of its sample rate. Timings
+// above the last bound are only reflected in the caller's total.
+func (histogram *TimerHistogram) Add(value, sampleRate float64) {
+	i := sort.SearchFloat64s(histogram.bounds, value)
+	if i < len(histogram.counts) {
+		histogram.counts[i] += 1 / sampleRate
+	}
+}
+
+func (histogram *TimerHistogram) Merge(other *TimerHistogram) {
+	if len(other.counts) != len(histogram.counts) {
+		errorlog("can't merge histograms with different bounds")
+		return
+	}
+	for i, count := range other.counts {
+		histogram.counts[i] += count
+	}
+}
+
+// Cumulative returns the number of timings at or below each bound.
+func (histogram *TimerHistogram) Cumulative() []float64 {
+	cumulative := make([]float64, len(histogram.counts))
+	total := 0.0
+	for i, count := range histogram.counts {
+		total += count
+		cumulative[i] = total
+	}
+	return cumulative
+}
+
+func (histogram *TimerHistogram) Reset() {
+	for i := range histogram.counts {
+		histogram.counts[i] = 0
+	}
+}
+
+// binSuffix returns the name given to a bucket in stat paths, e.g. "bin_0_5".
+func binSuffix(bound float64) string {
+	return "bin_" + percentileSuffix(bound)
+}
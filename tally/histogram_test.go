@@ -0,0 +1,58 @@
+package tally
+
+import (
+	"testing"
+)
+
+func TestTimerHistogramsFlag(t *testing.T) {
+	var histograms TimerHistograms
+	for _, invalid := range []string{"api.*", "[=1", "api.*=x", "api.*=2,1"} {
+		if err := histograms.Set(invalid); err == nil {
+			t.Errorf("expected error for %#v", invalid)
+		}
+	}
+	if err := histograms.Set("api.latency.*=5,10,25"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := histograms.Set("*=0.5, 1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := TimerHistograms{
+		{"api.latency.*", []float64{5, 10, 25}},
+		{"*", []float64{0.5, 1}},
+	}
+	if s, ok := assertDeepEqual(expected, histograms); !ok {
+		t.Error(s)
+	}
+	if histograms.String() != "api.latency.*=5,10,25 *=0.5,1" {
+		t.Errorf("unexpected string form %#v", histograms.String())
+	}
+	if s, ok := assertDeepEqual([]float64{5, 10, 25},
+		histograms.boundsFor("api.latency.get")); !ok {
+		t.Error(s)
+	}
+	if s, ok := assertDeepEqual([]float64{0.5, 1},
+		histograms.boundsFor("db.query")); !ok {
+		t.Error(s)
+	}
+}
+
+func TestTimerHistogram(t *testing.T) {
+	histogram := NewTimerHistogram([]float64{5, 10, 25})
+	for _, value := range []float64{1, 5, 6, 30} {
+		histogram.Add(value, 1)
+	}
+	histogram.Add(20, 0.5)
+	other := NewTimerHistogram([]float64{5, 10, 25})
+	other.Add(10, 1)
+	histogram.Merge(other)
+	expected := []float64{2, 4, 6}
+	if s, ok := assertDeepEqual(expected, histogram.Cumulative()); !ok {
+		t.Error(s)
+	}
+	histogram.Reset()
+	if s, ok := assertDeepEqual([]float64{0, 0, 0},
+		histogram.Cumulative()); !ok {
+		t.Error(s)
+	}
+}
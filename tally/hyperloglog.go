@@ -0,0 +1,75 @@
+package tally
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// HLL_PRECISION is the number of hash bits used to select a register. Each
+// sketch holds 2^HLL_PRECISION one-byte registers, giving a standard error of
+// about 1.04/sqrt(2^HLL_PRECISION), or 1.6%.
+const HLL_PRECISION = 12
+
+// HyperLogLog estimates the number of distinct strings added to it using a
+// fixed amount of memory. Sketches can be merged, in which case the result
+// estimates the cardinality of the union of their inputs.
+type HyperLogLog struct {
+	registers []uint8
+}
+
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{make([]uint8, 1<<HLL_PRECISION)}
+}
+
+// hashMember returns a well-mixed 64-bit hash of the given member. FNV alone
+// doesn't spread short inputs evenly enough across the high bits, so the
+// result is passed through the murmur3 finalizer.
+func hashMember(member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (hll *HyperLogLog) Add(member string) {
+	x := hashMember(member)
+	i := x >> (64 - HLL_PRECISION)
+	rank := uint8(bits.LeadingZeros64(x<<HLL_PRECISION|1<<(HLL_PRECISION-1))) + 1
+	if rank > hll.registers[i] {
+		hll.registers[i] = rank
+	}
+}
+
+// Merge folds the members observed by other into this sketch.
+func (hll *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > hll.registers[i] {
+			hll.registers[i] = rank
+		}
+	}
+}
+
+// Count returns the estimated number of distinct members added.
+func (hll *HyperLogLog) Count() float64 {
+	m := float64(len(hll.registers))
+	sum := 0.0
+	zeros := 0
+	for _, rank := range hll.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Floor(estimate + 0.5)
+}
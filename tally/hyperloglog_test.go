@@ -0,0 +1,44 @@
+package tally
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func assertEstimate(t *testing.T, expected int, hll *HyperLogLog) {
+	result := hll.Count()
+	if math.Abs(result-float64(expected)) > 0.05*float64(expected) {
+		t.Errorf("expected about %d distinct members, got %f", expected, result)
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	hll := NewHyperLogLog()
+	if hll.Count() != 0 {
+		t.Errorf("expected empty sketch to count 0, got %f", hll.Count())
+	}
+	for i := 0; i < 3; i++ {
+		hll.Add("x")
+	}
+	if hll.Count() != 1 {
+		t.Errorf("expected 1 distinct member, got %f", hll.Count())
+	}
+
+	hll = NewHyperLogLog()
+	for i := 0; i < 100000; i++ {
+		hll.Add(fmt.Sprintf("member%d", i%20000))
+	}
+	assertEstimate(t, 20000, hll)
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a := NewHyperLogLog()
+	b := NewHyperLogLog()
+	for i := 0; i < 1000; i++ {
+		a.Add(fmt.Sprintf("%d", i))
+		b.Add(fmt.Sprintf("%d", i+500))
+	}
+	a.Merge(b)
+	assertEstimate(t, 1500, a)
+}
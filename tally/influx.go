@@ -0,0 +1,280 @@
+package tally
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_INFLUX_BATCH_SIZE = 5000
+	DEFAULT_INFLUX_RETRIES    = 3
+	DEFAULT_INFLUX_TIMEOUT    = 10 * time.Second
+	// INFLUX_UDP_PAYLOAD is the most bytes sent in each UDP datagram, unless a
+	// single line is longer.
+	INFLUX_UDP_PAYLOAD = 1400
+)
+
+// InfluxBatchSize is an InfluxDB option setting the most lines sent in each
+// HTTP request.
+type InfluxBatchSize int
+
+// InfluxGzip is an InfluxDB option enabling gzip compression of HTTP request
+// bodies.
+type InfluxGzip bool
+
+// InfluxRetries is an InfluxDB option setting how many times a batch is
+// retried, after failing with a network or server error, before it's dropped.
+type InfluxRetries int
+
+// InfluxTimeout is an InfluxDB option bounding the time taken by each request.
+type InfluxTimeout time.Duration
+
+// InfluxDB is a backend that writes stats in InfluxDB's line protocol, either
+// to an HTTP write endpoint (e.g. "http://localhost:8086/write?db=stats") or
+// to a UDP listener (e.g. "udp://localhost:8089"). Each stat is written as a
+// measurement named by the mapping rules (or the stat's name), tagged with the
+// mapped tags and its type as metric_type:
+//
+//	counter: value, rate
+//	gauge, set, report: value
+//	timing: lower, upper, mean, median, stddev, sum, count, count_ps, and
+//		upper_<P>, mean_<P>, sum_<P>, count_<P> for each percentile
+//	string: count, with the string as the string tag
+//
+// Batches are delivered by a separate goroutine, so that flushes don't wait
+// for InfluxDB.
+type InfluxDB struct {
+	*batchSender
+	url       *url.URL
+	client    *http.Client
+	udpConn   net.Conn // nil unless writing to UDP
+	batchSize int
+	gzip      bool
+	mappings  StatMappings
+}
+
+func NewInfluxDB(address string, mappings StatMappings,
+	options ...interface{}) (influx *InfluxDB, err error) {
+	influx = &InfluxDB{
+		batchSize: DEFAULT_INFLUX_BATCH_SIZE,
+		mappings:  mappings,
+	}
+	influx.batchSender = newBatchSender("influxdb", DEFAULT_INFLUX_RETRIES,
+		influx.send)
+	timeout := DEFAULT_INFLUX_TIMEOUT
+	for _, option := range options {
+		switch option.(type) {
+		case InfluxBatchSize:
+			influx.batchSize = int(option.(InfluxBatchSize))
+		case InfluxGzip:
+			influx.gzip = bool(option.(InfluxGzip))
+		case InfluxRetries:
+			influx.retries = int(option.(InfluxRetries))
+		case InfluxTimeout:
+			timeout = time.Duration(option.(InfluxTimeout))
+		default:
+			err = errors.New(fmt.Sprintf("invalid influxdb option %T", option))
+			return
+		}
+	}
+	if influx.batchSize < 1 {
+		influx.batchSize = DEFAULT_INFLUX_BATCH_SIZE
+	}
+	if influx.url, err = url.Parse(address); err != nil {
+		return
+	}
+	switch influx.url.Scheme {
+	case "http", "https":
+		influx.client = &http.Client{Timeout: timeout}
+	case "udp":
+		if influx.udpConn, err = net.Dial("udp", influx.url.Host); err != nil {
+			return
+		}
+	default:
+		err = errors.New(fmt.Sprintf(
+			"influxdb address must be an http, https or udp url: %s", address))
+		return
+	}
+	go influx.run()
+	return
+}
+
+func (influx *InfluxDB) Name() string {
+	return "influxdb"
+}
+
+// Flush renders a snapshot as line protocol, timestamped in nanoseconds (the
+// write endpoint's default precision) but aligned to the second, and hands the
+// batches to the sender.
+func (influx *InfluxDB) Flush(snapshot SnapshotView) error {
+	return influx.queue(influx.batch(InfluxLines(snapshot, influx.mappings)))
+}
+
+// batch joins lines into batches of at most batchSize lines for HTTP, or of
+// at most INFLUX_UDP_PAYLOAD bytes for UDP.
+func (influx *InfluxDB) batch(lines []string) (batches [][]byte) {
+	var buffer bytes.Buffer
+	n := 0
+	for _, line := range lines {
+		full := n == influx.batchSize
+		if influx.udpConn != nil {
+			full = buffer.Len() > 0 &&
+				buffer.Len()+len(line) > INFLUX_UDP_PAYLOAD
+		}
+		if full {
+			batches = append(batches, append([]byte(nil), buffer.Bytes()...))
+			buffer.Reset()
+			n = 0
+		}
+		buffer.WriteString(line)
+		n++
+	}
+	if buffer.Len() > 0 {
+		batches = append(batches, buffer.Bytes())
+	}
+	return
+}
+
+// send makes one attempt to deliver a batch.
+func (influx *InfluxDB) send(batch []byte) (retry bool, err error) {
+	if influx.udpConn != nil {
+		_, err = influx.udpConn.Write(batch)
+		return true, err
+	}
+	return postBatch(influx.client, influx.url.String(),
+		"text/plain; charset=utf-8", batch, influx.gzip)
+}
+
+func (influx *InfluxDB) Status() string {
+	return fmt.Sprintf("writing to %s: %s", influx.url.Redacted(),
+		influx.status())
+}
+
+// Close waits for the sender to finish with the queued batches, then closes
+// the UDP socket if there is one.
+func (influx *InfluxDB) Close() error {
+	influx.close()
+	if influx.udpConn != nil {
+		return influx.udpConn.Close()
+	}
+	return nil
+}
+
+// InfluxLines renders each stat of a snapshot as a line of InfluxDB's line
+// protocol, with measurements and tags given by the mapping rules.
+func InfluxLines(snapshot SnapshotView, mappings StatMappings) []string {
+	timestamp := " " + strconv.FormatInt(
+		snapshot.Start().Truncate(time.Second).UnixNano(), 10) + "\n"
+	seconds := snapshot.Duration().Seconds()
+	lines := make([]string, 0, snapshot.NumStats())
+	makeLine := func(key, metricType string, extraTags []statTag,
+		fields []influxField, timestamp string) {
+		name, tags := mappings.apply(key)
+		tags = append(tags, statTag{"metric_type", metricType})
+		tags = append(tags, extraTags...)
+		if line := influxLine(name, tags, fields); line != "" {
+			lines = append(lines, line+timestamp)
+		}
+	}
+	snapshot.EachCount(func(key string, value float64) {
+		makeLine(key, "counter", nil, []influxField{
+			{"value", value}, {"rate", value / seconds}}, timestamp)
+	})
+	snapshot.EachGauge(func(key string, value float64) {
+		makeLine(key, "gauge", nil, []influxField{{"value", value}}, timestamp)
+	})
+	snapshot.EachSet(func(key string, count float64) {
+		makeLine(key, "set", nil, []influxField{{"value", count}}, timestamp)
+	})
+	percentiles := snapshot.TimerPercentiles()
+	snapshot.EachTimer(func(key string, timer TimerView) {
+		fields := []influxField{
+			{"lower", timer.Min()},
+			{"upper", timer.Max()},
+			{"mean", timer.Mean()},
+			{"median", timer.Quantile(0.5)},
+			{"stddev", timer.StdDev()},
+			{"sum", timer.Sum()},
+			{"count", timer.ScaledCount()},
+			{"count_ps", timer.ScaledCount() / seconds},
+		}
+		for _, p := range percentiles {
+			suffix := percentileSuffix(p)
+			count, sum := timer.Lower(p / 100)
+			fields = append(fields,
+				influxField{"upper_" + suffix, timer.Quantile(p / 100)},
+				influxField{"mean_" + suffix, sum / count},
+				influxField{"sum_" + suffix, sum},
+				influxField{"count_" + suffix, count})
+		}
+		makeLine(key, "timing", nil, fields, timestamp)
+	})
+	snapshot.EachReport(func(key string, value float64, ts time.Time) {
+		makeLine(key, "report", nil, []influxField{{"value", value}},
+			" "+strconv.FormatInt(ts.Truncate(time.Second).UnixNano(), 10)+
+				"\n")
+	})
+	snapshot.EachStringCount(func(key, value string, count float64) {
+		makeLine(key, "string", []statTag{{"string", value}},
+			[]influxField{{"count", count}}, timestamp)
+	})
+	return lines
+}
+
+type influxField struct {
+	name  string
+	value float64
+}
+
+var influxMeasurementEscaper = strings.NewReplacer(
+	",", `\,`, " ", `\ `, "\n", `\n`)
+var influxTagEscaper = strings.NewReplacer(
+	",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// influxLine renders a line without its timestamp, with tags sorted by name.
+// Fields that InfluxDB can't store (NaN and infinities) are left out, and the
+// line is empty if none are left, or if it has no measurement.
+func influxLine(measurement string, tags []statTag,
+	fields []influxField) string {
+	if measurement == "" {
+		return ""
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].name < tags[j].name
+	})
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, tag := range tags {
+		if tag.name == "" || tag.value == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(influxTagEscaper.Replace(tag.name))
+		b.WriteByte('=')
+		b.WriteString(influxTagEscaper.Replace(tag.value))
+	}
+	separator := byte(' ')
+	for _, field := range fields {
+		if math.IsNaN(field.value) || math.IsInf(field.value, 0) {
+			continue
+		}
+		b.WriteByte(separator)
+		separator = ','
+		b.WriteString(influxTagEscaper.Replace(field.name))
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(field.value, 'f', -1, 64))
+	}
+	if separator == ' ' {
+		return ""
+	}
+	return b.String()
+}
@@ -0,0 +1,179 @@
+package tally
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// influxServer stands in for InfluxDB's write endpoint, responding to each
+// request with the next of its statuses (or 204 once they run out), and
+// passing on the bodies received.
+type influxServer struct {
+	*httptest.Server
+	statuses []int
+	bodies   chan string
+}
+
+func newInfluxServer(statuses ...int) *influxServer {
+	server := &influxServer{statuses: statuses, bodies: make(chan string, 10)}
+	server.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				body, _ = gzip.NewReader(r.Body)
+			}
+			b, _ := ioutil.ReadAll(body)
+			server.bodies <- string(b)
+			status := http.StatusNoContent
+			if len(server.statuses) > 0 {
+				status, server.statuses = server.statuses[0], server.statuses[1:]
+			}
+			w.WriteHeader(status)
+		}))
+	return server
+}
+
+func (server *influxServer) receive(t *testing.T) string {
+	select {
+	case body := <-server.bodies:
+		return body
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing received")
+		return ""
+	}
+}
+
+func influxTestSnapshot() *Snapshot {
+	snapshot := NewSnapshot()
+	snapshot.start = time.Unix(1700000000, 0)
+	snapshot.duration = 10 * time.Second
+	snapshot.timerPercentiles = TimerPercentiles{90}
+	snapshot.Count("api.users.hits;route=/x", 5)
+	snapshot.Time("db.query", 4)
+	snapshot.Time("db.query", 4)
+	snapshot.Report("tallier.mem.alloc", 100, time.Unix(1700000005, 0))
+	snapshot.CountString("paths", "a b", 2)
+	return snapshot
+}
+
+func sortedLines(body string) []string {
+	lines := strings.SplitAfter(body, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestInfluxDB(t *testing.T) {
+	server := newInfluxServer()
+	defer server.Close()
+	var mappings StatMappings
+	mappings.Set("api.*.hits=hits,service=$1")
+	influx, err := NewInfluxDB(server.URL+"/write?db=stats", mappings,
+		InfluxGzip(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer influx.Close()
+	if err = influx.Flush(influxTestSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"db.query,metric_type=timing lower=4,upper=4,mean=4,median=4," +
+			"stddev=0,sum=8,count=2,count_ps=0.2,upper_90=4,mean_90=4," +
+			"sum_90=8,count_90=2 1700000000000000000\n",
+		"hits,metric_type=counter,route=/x,service=users value=5,rate=0.5 " +
+			"1700000000000000000\n",
+		`paths,metric_type=string,string=a\ b count=2 ` +
+			"1700000000000000000\n",
+		"tallier.mem.alloc,metric_type=report value=100 " +
+			"1700000005000000000\n",
+	}
+	if s, ok := assertDeepEqual(expected,
+		sortedLines(server.receive(t))); !ok {
+		t.Error(s)
+	}
+}
+
+func TestInfluxDBBatches(t *testing.T) {
+	server := newInfluxServer()
+	defer server.Close()
+	influx, _ := NewInfluxDB(server.URL, nil, InfluxBatchSize(3))
+	defer influx.Close()
+	snapshot := NewSnapshot()
+	snapshot.start = time.Unix(1700000000, 0)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		snapshot.Gauge(key, 1)
+	}
+	influx.Flush(snapshot)
+	first, second := server.receive(t), server.receive(t)
+	if strings.Count(first, "\n") != 3 || strings.Count(second, "\n") != 1 {
+		t.Errorf("expected batches of 3 and 1 lines, got:\n%s\n%s",
+			first, second)
+	}
+}
+
+func TestInfluxDBRetries(t *testing.T) {
+	server := newInfluxServer(http.StatusServiceUnavailable,
+		http.StatusBadRequest)
+	defer server.Close()
+	influx, _ := NewInfluxDB(server.URL, nil)
+	influx.backoff = time.Millisecond
+	snapshot := NewSnapshot()
+	snapshot.Gauge("x", 1)
+	influx.Flush(snapshot)
+	// retried after the server error, but not after the client error
+	first, second := server.receive(t), server.receive(t)
+	if first != second {
+		t.Errorf("expected the same batch to be retried, got %#v and %#v",
+			first, second)
+	}
+	influx.Close()
+	select {
+	case body := <-server.bodies:
+		t.Errorf("unexpected retry: %#v", body)
+	default:
+	}
+	influx.mu.Lock()
+	defer influx.mu.Unlock()
+	if influx.sent != 0 || influx.dropped != 1 {
+		t.Errorf("expected 1 dropped batch, got %d sent and %d dropped",
+			influx.sent, influx.dropped)
+	}
+}
+
+func TestInfluxDBUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	influx, err := NewInfluxDB("udp://"+conn.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer influx.Close()
+	snapshot := NewSnapshot()
+	snapshot.start = time.Unix(1700000000, 0)
+	snapshot.Gauge("x", 1)
+	influx.Flush(snapshot)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "x,metric_type=gauge value=1 1700000000000000000\n"
+	if string(b[:n]) != expected {
+		t.Errorf("expected %#v, got %#v", expected, string(b[:n]))
+	}
+}
@@ -4,28 +4,38 @@ import (
 	"io"
 	"log"
 	"log/syslog"
+	"sync"
 )
 
 var infologger *log.Logger
 var errorlogger *log.Logger
+var loggerLock sync.RWMutex // loggers may be changed while running
 
 func LogTo(out io.Writer) {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
 	infologger = log.New(out, "", log.LstdFlags)
 	errorlogger = infologger
 }
 
 func LogToSyslog() {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
 	infologger, _ = syslog.NewLogger(syslog.LOG_INFO, 0)
 	errorlogger, _ = syslog.NewLogger(syslog.LOG_ERR, 0)
 }
 
 func infolog(format string, params ...interface{}) {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
 	if infologger != nil {
 		infologger.Printf(format, params...)
 	}
 }
 
 func errorlog(format string, params ...interface{}) {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
 	if errorlogger != nil {
 		errorlogger.Printf("ERROR: "+format, params...)
 	}
@@ -0,0 +1,126 @@
+package tally
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StatMapping maps the stats whose names match a pattern to another name, and
+// tags, for backends that don't use graphite's dot-separated paths. The
+// pattern is matched against the dot-separated segments of a stat's name, a
+// "*" matching any one segment; the name and tag values may refer to the
+// segments matched by each "*" as $1, $2 and so on.
+type StatMapping struct {
+	pattern []string
+	name    string
+	tags    []statTag
+}
+
+type statTag struct {
+	name  string
+	value string
+}
+
+// StatMappings lists the rules for mapping stats' names. The first rule to
+// match a stat's name applies. It implements flag.Value; each call to Set
+// parses and appends one rule given in the form
+// "<PATTERN>=<NAME>[,<TAG>=<VALUE>...]", e.g.
+// "api.*.*.latency=api_latency,endpoint=$1,method=$2", so the flag may be
+// repeated.
+type StatMappings []StatMapping
+
+func (mappings *StatMappings) String() string {
+	rules := make([]string, len(*mappings))
+	for i, mapping := range *mappings {
+		fields := []string{strings.Join(mapping.pattern, ".") + "=" +
+			mapping.name}
+		for _, tag := range mapping.tags {
+			fields = append(fields, tag.name+"="+tag.value)
+		}
+		rules[i] = strings.Join(fields, ",")
+	}
+	return strings.Join(rules, " ")
+}
+
+func (mappings *StatMappings) Set(value string) error {
+	fields := strings.Split(value, ",")
+	i := strings.IndexByte(fields[0], '=')
+	if i <= 0 || i == len(fields[0])-1 {
+		return errors.New(
+			"mapping must be <PATTERN>=<NAME>[,<TAG>=<VALUE>...]")
+	}
+	mapping := StatMapping{
+		pattern: strings.Split(fields[0][:i], "."),
+		name:    fields[0][i+1:],
+	}
+	for _, field := range fields[1:] {
+		j := strings.IndexByte(field, '=')
+		if j <= 0 {
+			return errors.New(fmt.Sprintf(
+				"mapping tag must be <TAG>=<VALUE>: %s", field))
+		}
+		mapping.tags = append(mapping.tags, statTag{field[:j], field[j+1:]})
+	}
+	*mappings = append(*mappings, mapping)
+	return nil
+}
+
+var captureRegexp = regexp.MustCompile(`\$[0-9]+`)
+
+// match returns the name and tags for a stat name, if it matches the rule's
+// pattern.
+func (mapping *StatMapping) match(name string) (string, []statTag, bool) {
+	segments := strings.Split(name, ".")
+	if len(segments) != len(mapping.pattern) {
+		return "", nil, false
+	}
+	var captures []string
+	for i, segment := range segments {
+		if mapping.pattern[i] == "*" {
+			captures = append(captures, segment)
+		} else if mapping.pattern[i] != segment {
+			return "", nil, false
+		}
+	}
+	expand := func(template string) string {
+		return captureRegexp.ReplaceAllStringFunc(template,
+			func(ref string) string {
+				n, _ := strconv.Atoi(ref[1:])
+				if n < 1 || n > len(captures) {
+					return ""
+				}
+				return captures[n-1]
+			})
+	}
+	tags := make([]statTag, len(mapping.tags))
+	for i, tag := range mapping.tags {
+		tags[i] = statTag{tag.name, expand(tag.value)}
+	}
+	return expand(mapping.name), tags, true
+}
+
+// apply returns the mapped name and tags for a stat key, including the key's
+// own tags. Stats that match no rule keep their name.
+func (mappings StatMappings) apply(key string) (string, []statTag) {
+	name, keyTags := splitStatKey(key)
+	var tags []statTag
+	for i := range mappings {
+		if mapped, mappedTags, ok := mappings[i].match(name); ok {
+			name, tags = mapped, mappedTags
+			break
+		}
+	}
+	if keyTags != "" {
+		for _, tag := range strings.Split(keyTags, ";") {
+			k, v := tag, ""
+			if i := strings.IndexByte(tag, '='); i >= 0 {
+				k, v = tag[:i], tag[i+1:]
+			}
+			tags = append(tags, statTag{k, v})
+		}
+	}
+	return name, tags
+}
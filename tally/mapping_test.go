@@ -0,0 +1,33 @@
+package tally
+
+import "testing"
+
+func TestStatMappings(t *testing.T) {
+	var mappings StatMappings
+	for _, invalid := range []string{"api.*", "=x", "api.*=", "a=b,c"} {
+		if err := mappings.Set(invalid); err == nil {
+			t.Errorf("expected error for %#v", invalid)
+		}
+	}
+	rule := "api.*.*.latency=api_latency,endpoint=$1,method=$2"
+	if err := mappings.Set(rule); err != nil {
+		t.Fatal(err)
+	}
+	if mappings.String() != rule {
+		t.Errorf("unexpected string form %#v", mappings.String())
+	}
+
+	name, tags := mappings.apply("api.users.get.latency;status=200")
+	expected := []statTag{
+		{"endpoint", "users"}, {"method", "get"}, {"status", "200"}}
+	if s, ok := assertDeepEqual(expected, tags); !ok {
+		t.Error(s)
+	}
+	if name != "api_latency" {
+		t.Errorf("expected api_latency, got %s", name)
+	}
+	name, tags = mappings.apply("api.users.latency")
+	if name != "api.users.latency" || tags != nil {
+		t.Errorf("expected unmapped name, got %s %v", name, tags)
+	}
+}
@@ -0,0 +1,253 @@
+package tally
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_OPENTSDB_BATCH_SIZE = 500
+	DEFAULT_OPENTSDB_RETRIES    = 3
+	DEFAULT_OPENTSDB_TIMEOUT    = 10 * time.Second
+)
+
+// OpenTSDBBatchSize is an OpenTSDB option setting the most data points sent
+// in each request or telnet write.
+type OpenTSDBBatchSize int
+
+// OpenTSDBHostTag is an OpenTSDB option setting the host tag given to data
+// points that don't have one from their key or mapping rule.
+type OpenTSDBHostTag string
+
+// OpenTSDBRetries is an OpenTSDB option setting how many times a batch is
+// retried, after failing with a network or server error, before it's dropped.
+type OpenTSDBRetries int
+
+// OpenTSDBTimeout is an OpenTSDB option bounding the time taken to connect and
+// by each request or write.
+type OpenTSDBTimeout time.Duration
+
+// OpenTSDBPoint is a data point, as sent to OpenTSDB's /api/put.
+type OpenTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// OpenTSDB is a backend that sends stats to OpenTSDB, either as put lines over
+// its telnet interface (e.g. "tcp://localhost:4242") or as JSON batches to its
+// HTTP API (e.g. "http://localhost:4242", posting to /api/put unless another
+// path is given). Each stat is sent as one or more metrics named by the
+// mapping rules (or the stat's name), with the mapped tags:
+//
+//	counter: <NAME>.count, <NAME>.rate
+//	gauge, set, report: <NAME>
+//	timing: <NAME>.lower, .upper, .mean, .median, .stddev, .sum, .count,
+//		.count_ps, and .upper_<P>, .mean_<P>, .sum_<P>, .count_<P> for each
+//		percentile
+//
+// OpenTSDB requires every data point to have a tag, so a default host tag
+// should be configured unless every stat has tags of its own.
+type OpenTSDB struct {
+	*batchSender
+	url       *url.URL
+	client    *http.Client // nil if using telnet
+	batchSize int
+	hostTag   string
+	mappings  StatMappings
+	telnet    *streamWriter // nil if using http, only used by the sender
+}
+
+func NewOpenTSDB(address string, mappings StatMappings,
+	options ...interface{}) (tsdb *OpenTSDB, err error) {
+	tsdb = &OpenTSDB{
+		batchSize: DEFAULT_OPENTSDB_BATCH_SIZE,
+		mappings:  mappings,
+	}
+	timeout := DEFAULT_OPENTSDB_TIMEOUT
+	tsdb.batchSender = newBatchSender("opentsdb", DEFAULT_OPENTSDB_RETRIES,
+		tsdb.send)
+	for _, option := range options {
+		switch option.(type) {
+		case OpenTSDBBatchSize:
+			tsdb.batchSize = int(option.(OpenTSDBBatchSize))
+		case OpenTSDBHostTag:
+			tsdb.hostTag = string(option.(OpenTSDBHostTag))
+		case OpenTSDBRetries:
+			tsdb.retries = int(option.(OpenTSDBRetries))
+		case OpenTSDBTimeout:
+			timeout = time.Duration(option.(OpenTSDBTimeout))
+		default:
+			err = errors.New(fmt.Sprintf("invalid opentsdb option %T", option))
+			return
+		}
+	}
+	if tsdb.batchSize < 1 {
+		tsdb.batchSize = DEFAULT_OPENTSDB_BATCH_SIZE
+	}
+	if tsdb.url, err = url.Parse(address); err != nil {
+		return
+	}
+	switch tsdb.url.Scheme {
+	case "http", "https":
+		tsdb.client = &http.Client{Timeout: timeout}
+		if tsdb.url.Path == "" || tsdb.url.Path == "/" {
+			tsdb.url.Path = "/api/put"
+		}
+	case "tcp", "telnet":
+		tsdb.telnet = &streamWriter{address: tsdb.url.Host, timeout: timeout}
+	default:
+		err = errors.New(fmt.Sprintf(
+			"opentsdb address must be a tcp, http or https url: %s", address))
+		return
+	}
+	go tsdb.run()
+	return
+}
+
+func (tsdb *OpenTSDB) Name() string {
+	return "opentsdb"
+}
+
+// Flush renders a snapshot's data points in batches of at most batchSize, as a
+// JSON array for /api/put or as put lines for telnet, and hands them to the
+// sender.
+func (tsdb *OpenTSDB) Flush(snapshot SnapshotView) error {
+	points := OpenTSDBPoints(snapshot, tsdb.mappings, tsdb.hostTag)
+	var batches [][]byte
+	for len(points) > 0 {
+		batch := points
+		if len(batch) > tsdb.batchSize {
+			batch = batch[:tsdb.batchSize]
+		}
+		points = points[len(batch):]
+		if tsdb.client != nil {
+			body, err := json.Marshal(batch)
+			if err != nil {
+				return err
+			}
+			batches = append(batches, body)
+		} else {
+			batches = append(batches, putLines(batch))
+		}
+	}
+	return tsdb.queue(batches)
+}
+
+// putLines renders data points as telnet put commands.
+func putLines(points []OpenTSDBPoint) []byte {
+	var buffer bytes.Buffer
+	for _, point := range points {
+		fmt.Fprintf(&buffer, "put %s %d %s", point.Metric, point.Timestamp,
+			strconv.FormatFloat(point.Value, 'f', -1, 64))
+		names := make([]string, 0, len(point.Tags))
+		for name := range point.Tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&buffer, " %s=%s", name, point.Tags[name])
+		}
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+// send makes one attempt to deliver a batch. Telnet connections are kept open
+// between batches, and reopened after an error.
+func (tsdb *OpenTSDB) send(batch []byte) (retry bool, err error) {
+	if tsdb.client != nil {
+		return postBatch(tsdb.client, tsdb.url.String(), "application/json",
+			batch, false)
+	}
+	return true, tsdb.telnet.write(batch)
+}
+
+func (tsdb *OpenTSDB) Status() string {
+	return fmt.Sprintf("writing to %s: %s", tsdb.url.Redacted(), tsdb.status())
+}
+
+// Close waits for the sender to finish with the queued batches, then closes
+// the telnet connection if one is open.
+func (tsdb *OpenTSDB) Close() error {
+	tsdb.close()
+	if tsdb.telnet != nil {
+		return tsdb.telnet.close()
+	}
+	return nil
+}
+
+var openTSDBInvalidChars = regexp.MustCompile(`[^-a-zA-Z0-9_./\pL]`)
+
+// OpenTSDBPoints converts the stats of a snapshot to OpenTSDB data points,
+// with metric names and tags given by the mapping rules. Characters OpenTSDB
+// doesn't allow are replaced with underscores.
+func OpenTSDBPoints(snapshot SnapshotView, mappings StatMappings,
+	hostTag string) []OpenTSDBPoint {
+	timestamp := snapshot.Start().Unix()
+	seconds := snapshot.Duration().Seconds()
+	points := make([]OpenTSDBPoint, 0, 2*snapshot.NumStats())
+	add := func(key string, suffixes []string, values []float64, ts int64) {
+		name, mapped := mappings.apply(key)
+		tags := make(map[string]string)
+		if hostTag != "" {
+			tags["host"] = hostTag
+		}
+		for _, tag := range mapped {
+			value := openTSDBInvalidChars.ReplaceAllString(tag.value, "_")
+			if tag.name != "" && value != "" {
+				tags[openTSDBInvalidChars.ReplaceAllString(tag.name, "_")] =
+					value
+			}
+		}
+		name = openTSDBInvalidChars.ReplaceAllString(name, "_")
+		for i, suffix := range suffixes {
+			if math.IsNaN(values[i]) || math.IsInf(values[i], 0) {
+				continue
+			}
+			points = append(points,
+				OpenTSDBPoint{name + suffix, ts, values[i], tags})
+		}
+	}
+	snapshot.EachCount(func(key string, value float64) {
+		add(key, []string{".count", ".rate"},
+			[]float64{value, value / seconds}, timestamp)
+	})
+	snapshot.EachGauge(func(key string, value float64) {
+		add(key, []string{""}, []float64{value}, timestamp)
+	})
+	snapshot.EachSet(func(key string, count float64) {
+		add(key, []string{""}, []float64{count}, timestamp)
+	})
+	percentiles := snapshot.TimerPercentiles()
+	snapshot.EachTimer(func(key string, timer TimerView) {
+		suffixes := []string{".lower", ".upper", ".mean", ".median",
+			".stddev", ".sum", ".count", ".count_ps"}
+		values := []float64{timer.Min(), timer.Max(), timer.Mean(),
+			timer.Quantile(0.5), timer.StdDev(), timer.Sum(),
+			timer.ScaledCount(), timer.ScaledCount() / seconds}
+		for _, p := range percentiles {
+			suffix := percentileSuffix(p)
+			count, sum := timer.Lower(p / 100)
+			suffixes = append(suffixes, ".upper_"+suffix, ".mean_"+suffix,
+				".sum_"+suffix, ".count_"+suffix)
+			values = append(values, timer.Quantile(p/100), sum/count, sum,
+				count)
+		}
+		add(key, suffixes, values, timestamp)
+	})
+	snapshot.EachReport(func(key string, value float64, ts time.Time) {
+		add(key, []string{""}, []float64{value}, ts.Unix())
+	})
+	return points
+}
@@ -0,0 +1,141 @@
+package tally
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOpenTSDBPoints(t *testing.T) {
+	var mappings StatMappings
+	mappings.Set("api.*.hits=api.hits,service=$1")
+	snapshot := NewSnapshot()
+	snapshot.start = time.Unix(1700000000, 0)
+	snapshot.duration = 10 * time.Second
+	snapshot.Count("api.users.hits", 5)
+	snapshot.Gauge("queue depth;host=web1", 7)
+	points := OpenTSDBPoints(snapshot, mappings, "tallier1")
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Metric < points[j].Metric
+	})
+	expected := []OpenTSDBPoint{
+		{"api.hits.count", 1700000000, 5,
+			map[string]string{"host": "tallier1", "service": "users"}},
+		{"api.hits.rate", 1700000000, 0.5,
+			map[string]string{"host": "tallier1", "service": "users"}},
+		{"queue_depth", 1700000000, 7, map[string]string{"host": "web1"}},
+	}
+	if s, ok := assertDeepEqual(expected, points); !ok {
+		t.Error(s)
+	}
+}
+
+func TestOpenTSDBTelnet(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	tsdb, err := NewOpenTSDB("tcp://"+listener.Addr().String(), nil,
+		OpenTSDBHostTag("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tsdb.Close()
+	tsdb.Flush(influxTestSnapshot())
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	var lines []string
+	for len(lines) < 15 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	expected := []string{
+		"put api.users.hits.count 1700000000 5 host=a route=/x\n",
+		"put api.users.hits.rate 1700000000 0.5 host=a route=/x\n",
+		"put db.query.count 1700000000 2 host=a\n",
+		"put db.query.count_90 1700000000 2 host=a\n",
+		"put db.query.count_ps 1700000000 0.2 host=a\n",
+		"put db.query.lower 1700000000 4 host=a\n",
+		"put db.query.mean 1700000000 4 host=a\n",
+		"put db.query.mean_90 1700000000 4 host=a\n",
+		"put db.query.median 1700000000 4 host=a\n",
+		"put db.query.stddev 1700000000 0 host=a\n",
+		"put db.query.sum 1700000000 8 host=a\n",
+		"put db.query.sum_90 1700000000 8 host=a\n",
+		"put db.query.upper 1700000000 4 host=a\n",
+		"put db.query.upper_90 1700000000 4 host=a\n",
+		"put tallier.mem.alloc 1700000005 100 host=a\n",
+	}
+	if s, ok := assertDeepEqual(expected, lines); !ok {
+		t.Error(s)
+	}
+}
+
+func TestOpenTSDBHTTP(t *testing.T) {
+	paths := make(chan string, 10)
+	bodies := make(chan []OpenTSDBPoint, 10)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var points []OpenTSDBPoint
+			json.NewDecoder(r.Body).Decode(&points)
+			paths <- r.URL.Path
+			bodies <- points
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer server.Close()
+	tsdb, err := NewOpenTSDB(server.URL, nil, OpenTSDBHostTag("a"),
+		OpenTSDBBatchSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tsdb.Close()
+	snapshot := NewSnapshot()
+	snapshot.start = time.Unix(1700000000, 0)
+	snapshot.Gauge("x", 1)
+	snapshot.Gauge("y", 2)
+	tsdb.Flush(snapshot)
+	var metrics []string
+	for i := 0; i < 2; i++ {
+		select {
+		case points := <-bodies:
+			if path := <-paths; path != "/api/put" {
+				t.Errorf("expected a request to /api/put, got %s", path)
+			}
+			if len(points) != 1 {
+				t.Fatalf("expected batches of 1 point, got %v", points)
+			}
+			metrics = append(metrics, points[0].Metric)
+			if points[0].Timestamp != 1700000000 ||
+				points[0].Tags["host"] != "a" {
+				t.Errorf("unexpected point %v", points[0])
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("nothing received")
+		}
+	}
+	sort.Strings(metrics)
+	if s, ok := assertDeepEqual([]string{"x", "y"}, metrics); !ok {
+		t.Error(s)
+	}
+}
+
+func TestOpenTSDBInvalidAddress(t *testing.T) {
+	if _, err := NewOpenTSDB("udp://localhost:4242", nil); err == nil {
+		t.Error("expected an error for a udp address")
+	}
+}
@@ -0,0 +1,149 @@
+package tally
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_PICKLE_BATCH_SIZE = 500
+
+// GraphiteProtocol is a graphite option selecting the protocol reports are
+// sent in.
+type GraphiteProtocol int
+
+const (
+	// GRAPHITE_PLAINTEXT sends "path value timestamp" lines, as accepted by
+	// carbon on port 2003.
+	GRAPHITE_PLAINTEXT GraphiteProtocol = iota
+	// GRAPHITE_PICKLE sends length-prefixed pickled lists of
+	// (path, (timestamp, value)) tuples, as accepted by carbon on port 2004.
+	GRAPHITE_PICKLE
+)
+
+var graphiteProtocolNames = []string{"plaintext", "pickle"}
+
+func (protocol *GraphiteProtocol) String() string {
+	return graphiteProtocolNames[*protocol]
+}
+
+func (protocol *GraphiteProtocol) Set(value string) error {
+	for i, name := range graphiteProtocolNames {
+		if value == name {
+			*protocol = GraphiteProtocol(i)
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("graphite protocol must be one of: %s",
+		strings.Join(graphiteProtocolNames, ", ")))
+}
+
+// PickleBatchSize is a graphite option setting the most stats pickled into
+// each message of the pickle protocol.
+type PickleBatchSize int
+
+// pickle opcodes, from python's pickle module (protocol 2)
+const (
+	PICKLE_PROTO      = 0x80
+	PICKLE_EMPTY_LIST = ']'
+	PICKLE_MARK       = '('
+	PICKLE_APPENDS    = 'e'
+	PICKLE_BINUNICODE = 'X'
+	PICKLE_BININT     = 'J'
+	PICKLE_LONG1      = 0x8a
+	PICKLE_BINFLOAT   = 'G'
+	PICKLE_TUPLE2     = 0x86
+	PICKLE_STOP       = '.'
+)
+
+type pickleStat struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// writePickled converts a report rendered in the plaintext protocol to the
+// pickle protocol, writing each batch of stats as a message. Lines that can't
+// be parsed are skipped.
+func writePickled(w io.Writer, report []byte, batchSize int) error {
+	if batchSize < 1 {
+		batchSize = DEFAULT_PICKLE_BATCH_SIZE
+	}
+	batch := make([]pickleStat, 0, batchSize)
+	var message []byte
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		message = appendPickleMessage(message[:0], batch)
+		batch = batch[:0]
+		_, err := w.Write(message)
+		return err
+	}
+	for len(report) > 0 {
+		line := report
+		if i := bytes.IndexByte(report, '\n'); i >= 0 {
+			line, report = report[:i], report[i+1:]
+		} else {
+			report = nil
+		}
+		stat, ok := parsePlaintextLine(string(line))
+		if !ok {
+			continue
+		}
+		batch = append(batch, stat)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+func parsePlaintextLine(line string) (stat pickleStat, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return
+	}
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return
+	}
+	return pickleStat{fields[0], value, timestamp}, true
+}
+
+// appendPickleMessage appends a message of the pickle protocol to b: a 4-byte
+// big-endian length, followed by the pickled list of stats.
+func appendPickleMessage(b []byte, stats []pickleStat) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+	b = append(b, PICKLE_PROTO, 2, PICKLE_EMPTY_LIST, PICKLE_MARK)
+	for _, stat := range stats {
+		b = append(b, PICKLE_BINUNICODE)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(stat.path)))
+		b = append(b, stat.path...)
+		if stat.timestamp >= math.MinInt32 && stat.timestamp <= math.MaxInt32 {
+			b = append(b, PICKLE_BININT)
+			b = binary.LittleEndian.AppendUint32(b, uint32(stat.timestamp))
+		} else {
+			b = append(b, PICKLE_LONG1, 8)
+			b = binary.LittleEndian.AppendUint64(b, uint64(stat.timestamp))
+		}
+		b = append(b, PICKLE_BINFLOAT)
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(stat.value))
+		b = append(b, PICKLE_TUPLE2, PICKLE_TUPLE2)
+	}
+	b = append(b, PICKLE_APPENDS, PICKLE_STOP)
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
@@ -0,0 +1,83 @@
+package tally
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestAppendPickleMessage(t *testing.T) {
+	message := appendPickleMessage(nil, []pickleStat{
+		{"a.b", 1.5, 1000},
+		{"c", -2, 1 << 32},
+	})
+	expected := []byte{
+		0, 0, 0, 57, // length
+		0x80, 2, ']', '(',
+		'X', 3, 0, 0, 0, 'a', '.', 'b',
+		'J', 0xe8, 0x03, 0, 0,
+		'G', 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+		0x86, 0x86,
+		'X', 1, 0, 0, 0, 'c',
+		0x8a, 8, 0, 0, 0, 0, 1, 0, 0, 0,
+		'G', 0xc0, 0, 0, 0, 0, 0, 0, 0,
+		0x86, 0x86,
+		'e', '.',
+	}
+	if s, ok := assertDeepEqual(expected, message); !ok {
+		t.Error(s)
+	}
+}
+
+func TestWritePickled(t *testing.T) {
+	var buffer bytes.Buffer
+	report := []byte("a 1.000000 10\nb 2.000000 10\nbogus\nc 3.000000 10\n")
+	if err := writePickled(&buffer, report, 2); err != nil {
+		t.Fatal(err)
+	}
+	expected := appendPickleMessage(nil, []pickleStat{
+		{"a", 1, 10}, {"b", 2, 10}})
+	expected = appendPickleMessage(expected, []pickleStat{{"c", 3, 10}})
+	if s, ok := assertDeepEqual(expected, buffer.Bytes()); !ok {
+		t.Error(s)
+	}
+}
+
+func TestSendReportPickled(t *testing.T) {
+	dialer := new(bufDialer)
+	graphite, err := NewGraphite("localhost:7", dialer, GRAPHITE_PICKLE,
+		PickleBatchSize(100))
+	snapshot := testSnapshot()
+	if err == nil {
+		err = graphite.SendReport(snapshot)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sent := dialer.buffer.Bytes()
+	if len(sent) < 4 ||
+		int(binary.BigEndian.Uint32(sent)) != len(sent)-4 {
+		t.Fatalf("expected one length-prefixed message, got %v", sent)
+	}
+	var expected bytes.Buffer
+	writePickled(&expected, RenderReport(snapshot), 100)
+	if s, ok := assertDeepEqual(expected.Bytes(), sent); !ok {
+		t.Error(s)
+	}
+}
+
+func TestGraphiteProtocolFlag(t *testing.T) {
+	var protocol GraphiteProtocol
+	if err := protocol.Set("pickle"); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := assertDeepEqual(GRAPHITE_PICKLE, protocol); !ok {
+		t.Error(s)
+	}
+	if s, ok := assertDeepEqual("pickle", protocol.String()); !ok {
+		t.Error(s)
+	}
+	if err := protocol.Set("json"); err == nil {
+		t.Error("expected error for unknown protocol")
+	}
+}
@@ -0,0 +1,360 @@
+package tally
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var promInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+var promInvalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func promMetricName(name string) string {
+	name = promInvalidChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func promLabelName(name string) string {
+	name = promInvalidLabelChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+type promLabel statTag
+
+var promLabelValueReplacer = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// renderLabels renders labels in the exposition format, with any extra label
+// (such as a quantile) last.
+func renderLabels(labels []promLabel, extra ...promLabel) string {
+	labels = append(labels[:len(labels):len(labels)], extra...)
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = label.name + `="` +
+			promLabelValueReplacer.Replace(label.value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+const (
+	PROM_COUNTER   = "counter"
+	PROM_GAUGE     = "gauge"
+	PROM_SUMMARY   = "summary"
+	PROM_HISTOGRAM = "histogram"
+)
+
+// DEFAULT_PROMETHEUS_EXPIRY is the number of flushes after which a series
+// that hasn't been updated is removed, by default.
+const DEFAULT_PROMETHEUS_EXPIRY = 60
+
+// PrometheusExpiry is a Prometheus option setting the number of flushes after
+// which a series that hasn't been updated is removed.
+type PrometheusExpiry int
+
+// promSeries is the state of one metric with a particular set of labels.
+type promSeries struct {
+	updated   int64          // number of the flush that last updated it
+	labels    []promLabel    // sorted by name
+	value     float64        // of a counter or gauge
+	quantiles []promQuantile // of a summary, for the last interval
+	sum       float64        // of a summary or histogram
+	count     float64        // of a summary or histogram
+	bounds    []float64      // of a histogram
+	buckets   []float64      // cumulative counts of a histogram
+}
+
+type promQuantile struct {
+	q     float64
+	value float64
+}
+
+type promFamily struct {
+	kind   string
+	series map[string]*promSeries // by rendered labels
+}
+
+// Prometheus is a backend that keeps the stats of each snapshot for the status
+// server to expose to Prometheus at /metrics. Stats are named by the first of
+// its mapping rules to match, or otherwise by replacing the characters
+// Prometheus doesn't allow (such as dots) with underscores. Counts are
+// accumulated into counters (with names suffixed by "_total"), and sets are
+// exposed as gauges of their size in the last interval. Timers are exposed as summaries with the
+// configured percentiles as quantiles, or as histograms if they're configured
+// with one (see TimerHistograms); their sums and counts accumulate, both scaled
+// up for timings reported at a sample rate.
+//
+// A series that isn't updated for a number of flushes (see PrometheusExpiry)
+// is removed, so that stats that are no longer sent don't linger with stale
+// values. A counter that's sent again after expiring starts again from zero,
+// which Prometheus treats as a counter reset.
+type Prometheus struct {
+	mu        sync.Mutex
+	mappings  StatMappings
+	families  map[string]*promFamily
+	expiry    int64
+	flushes   int64
+	lastFlush time.Time
+	conflicts map[string]bool // metric names logged as having two types
+}
+
+func NewPrometheus(mappings StatMappings,
+	options ...interface{}) (prom *Prometheus, err error) {
+	prom = &Prometheus{
+		mappings:  mappings,
+		families:  make(map[string]*promFamily),
+		expiry:    DEFAULT_PROMETHEUS_EXPIRY,
+		conflicts: make(map[string]bool),
+	}
+	for _, option := range options {
+		switch option.(type) {
+		case PrometheusExpiry:
+			prom.expiry = int64(option.(PrometheusExpiry))
+		default:
+			err = errors.New(fmt.Sprintf("invalid prometheus option %T", option))
+			return
+		}
+	}
+	if prom.expiry < 1 {
+		prom.expiry = DEFAULT_PROMETHEUS_EXPIRY
+	}
+	return
+}
+
+// metric returns the Prometheus metric name and labels for a stat key, as
+// mapped by the backend's rules, including labels for its tags. A tag named
+// after the label its metric type reserves ("quantile" for a summary, "le" for
+// a histogram) is renamed with an "exported_" prefix, as Prometheus does with
+// labels that clash with its own. Of two tags with the same label name, the
+// first is kept, so the labels of a mapping rule take precedence over the tags
+// in the key.
+func (prom *Prometheus) metric(key, reserved string) (string, []promLabel) {
+	name, tags := prom.mappings.apply(key)
+	labels := make([]promLabel, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		label := promLabel{promLabelName(tag.name), tag.value}
+		if label.name == reserved {
+			label.name = "exported_" + label.name
+		}
+		if !seen[label.name] {
+			seen[label.name] = true
+			labels = append(labels, label)
+		}
+	}
+	return promMetricName(name), labels
+}
+
+func (prom *Prometheus) Name() string {
+	return "prometheus"
+}
+
+// Path is where the status server serves the metrics.
+func (prom *Prometheus) Path() string {
+	return "/metrics"
+}
+
+func (prom *Prometheus) Flush(snapshot SnapshotView) error {
+	prom.mu.Lock()
+	defer prom.mu.Unlock()
+	prom.flushes++
+	percentiles := snapshot.TimerPercentiles()
+	snapshot.EachCount(func(key string, value float64) {
+		name, labels := prom.metric(key, "")
+		if !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+		if series := prom.series(name, PROM_COUNTER, labels); series != nil {
+			series.value += value
+		}
+	})
+	gauge := func(key string, value float64) {
+		name, labels := prom.metric(key, "")
+		if series := prom.series(name, PROM_GAUGE, labels); series != nil {
+			series.value = value
+		}
+	}
+	snapshot.EachGauge(gauge)
+	snapshot.EachSet(gauge)
+	snapshot.EachReport(func(key string, value float64, _ time.Time) {
+		gauge(key, value)
+	})
+	snapshot.EachTimer(func(key string, timer TimerView) {
+		bounds, cumulative := timer.Histogram()
+		kind, reserved := PROM_SUMMARY, "quantile"
+		if bounds != nil {
+			kind, reserved = PROM_HISTOGRAM, "le"
+		}
+		name, labels := prom.metric(key, reserved)
+		series := prom.series(name, kind, labels)
+		if series == nil {
+			return
+		}
+		series.sum += timer.ScaledSum()
+		series.count += timer.ScaledCount()
+		if kind == PROM_SUMMARY {
+			series.quantiles = make([]promQuantile, len(percentiles))
+			for i, p := range percentiles {
+				series.quantiles[i] = promQuantile{p / 100,
+					timer.Quantile(p / 100)}
+			}
+			return
+		}
+		if len(series.bounds) != len(bounds) {
+			series.bounds = bounds
+			series.buckets = make([]float64, len(bounds))
+		}
+		for i, count := range cumulative {
+			series.buckets[i] += count
+		}
+	})
+	prom.expire()
+	prom.lastFlush = time.Now()
+	return nil
+}
+
+// expire removes the series that haven't been updated within the expiry, and
+// any families left empty. Must be called with the lock held.
+func (prom *Prometheus) expire() {
+	for name, family := range prom.families {
+		for key, series := range family.series {
+			if prom.flushes-series.updated >= prom.expiry {
+				delete(family.series, key)
+			}
+		}
+		if len(family.series) == 0 {
+			delete(prom.families, name)
+		}
+	}
+}
+
+// series finds or creates the series for a metric, marking it updated by the
+// current flush, or returns nil if the name is already used for a different
+// type of metric. Must be called with the lock held.
+func (prom *Prometheus) series(name, kind string,
+	labels []promLabel) *promSeries {
+	family, ok := prom.families[name]
+	if !ok {
+		family = &promFamily{kind, make(map[string]*promSeries)}
+		prom.families[name] = family
+	} else if family.kind != kind {
+		if !prom.conflicts[name] {
+			prom.conflicts[name] = true
+			errorlog("prometheus metric %s is both a %s and a %s",
+				name, family.kind, kind)
+		}
+		return nil
+	}
+	sort.SliceStable(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+	key := renderLabels(labels)
+	series, ok := family.series[key]
+	if !ok {
+		series = &promSeries{labels: labels}
+		family.series[key] = series
+	}
+	series.updated = prom.flushes
+	return series
+}
+
+func (prom *Prometheus) Status() string {
+	prom.mu.Lock()
+	defer prom.mu.Unlock()
+	if prom.lastFlush.IsZero() {
+		return "no stats yet"
+	}
+	return fmt.Sprintf("%d metrics, last updated %s", len(prom.families),
+		prom.lastFlush.Format("2006-01-02 15:04:05"))
+}
+
+func (prom *Prometheus) Close() error {
+	return nil
+}
+
+func (prom *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buffered := bufio.NewWriter(w)
+	prom.WriteMetrics(buffered)
+	buffered.Flush()
+}
+
+// WriteMetrics writes all the metrics in Prometheus's text exposition format,
+// sorted by name and labels.
+func (prom *Prometheus) WriteMetrics(w io.Writer) {
+	prom.mu.Lock()
+	defer prom.mu.Unlock()
+	names := make([]string, 0, len(prom.families))
+	for name := range prom.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := prom.families[name]
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			series := family.series[key]
+			switch family.kind {
+			case PROM_COUNTER, PROM_GAUGE:
+				fmt.Fprintf(w, "%s%s %s\n", name, key, promValue(series.value))
+			case PROM_SUMMARY:
+				for _, q := range series.quantiles {
+					fmt.Fprintf(w, "%s%s %s\n", name,
+						renderLabels(series.labels,
+							promLabel{"quantile", promValue(q.q)}),
+						promValue(q.value))
+				}
+				fmt.Fprintf(w, "%s_sum%s %s\n", name, key, promValue(series.sum))
+				fmt.Fprintf(w, "%s_count%s %s\n", name, key,
+					promValue(series.count))
+			case PROM_HISTOGRAM:
+				for i, bound := range series.bounds {
+					fmt.Fprintf(w, "%s_bucket%s %s\n", name,
+						renderLabels(series.labels,
+							promLabel{"le", promValue(bound)}),
+						promValue(series.buckets[i]))
+				}
+				fmt.Fprintf(w, "%s_bucket%s %s\n", name,
+					renderLabels(series.labels, promLabel{"le", "+Inf"}),
+					promValue(series.count))
+				fmt.Fprintf(w, "%s_sum%s %s\n", name, key, promValue(series.sum))
+				fmt.Fprintf(w, "%s_count%s %s\n", name, key,
+					promValue(series.count))
+			}
+		}
+	}
+}
+
+func promValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,215 @@
+package tally
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetricNames(t *testing.T) {
+	var mappings StatMappings
+	mappings.Set("api.*.*.latency=api_latency,endpoint=$1,method=$2")
+	mappings.Set("api.*=api_other")
+	prom, _ := NewPrometheus(mappings)
+	for _, test := range []struct {
+		key    string
+		name   string
+		labels []promLabel
+	}{
+		{"api.users.get.latency;status=200", "api_latency", []promLabel{
+			{"endpoint", "users"}, {"method", "get"}, {"status", "200"}}},
+		{"api.users", "api_other", []promLabel{}},
+		{"api.users.latency", "api_users_latency", []promLabel{}},
+		{"a.b;c.d=e", "a_b", []promLabel{{"c_d", "e"}}},
+		{"5xx-errors;2=x", "_5xx_errors", []promLabel{{"_2", "x"}}},
+	} {
+		name, labels := prom.metric(test.key, "")
+		if name != test.name {
+			t.Errorf("expected %s for %s, got %s", test.name, test.key, name)
+		}
+		if s, ok := assertDeepEqual(test.labels, labels); !ok {
+			t.Errorf("%s: %s", test.key, s)
+		}
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	defer SetTimerHistograms(nil)
+	SetTimerHistograms(TimerHistograms{{"db.*", []float64{5, 10}}})
+	var mappings StatMappings
+	mappings.Set("api.*.requests=api_requests,endpoint=$1")
+	prom, _ := NewPrometheus(mappings)
+
+	snapshot := NewSnapshot()
+	snapshot.timerPercentiles = TimerPercentiles{90}
+	snapshot.duration = 10 * time.Second
+	snapshot.Count("api.users.requests", 3)
+	snapshot.Count("hits;host=a\"b", 2)
+	snapshot.Gauge("queue.depth", 7)
+	snapshot.Time("api.latency", 2)
+	snapshot.Time("db.query", 4)
+	snapshot.Time("db.query", 8)
+	prom.Flush(snapshot)
+	snapshot.Flush()
+	snapshot.Count("api.users.requests", 1)
+	snapshot.Time("db.query", 20)
+	prom.Flush(snapshot)
+
+	var buffer bytes.Buffer
+	prom.WriteMetrics(&buffer)
+	expected := strings.Join([]string{
+		"# TYPE api_latency summary",
+		`api_latency{quantile="0.9"} 2`,
+		"api_latency_sum 2",
+		"api_latency_count 1",
+		"# TYPE api_requests_total counter",
+		`api_requests_total{endpoint="users"} 4`,
+		"# TYPE db_query histogram",
+		`db_query_bucket{le="5"} 1`,
+		`db_query_bucket{le="10"} 2`,
+		`db_query_bucket{le="+Inf"} 3`,
+		"db_query_sum 32",
+		"db_query_count 3",
+		"# TYPE hits_total counter",
+		`hits_total{host="a\"b"} 2`,
+		"# TYPE queue_depth gauge",
+		"queue_depth 7",
+		"",
+	}, "\n")
+	if result := buffer.String(); result != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+}
+
+func TestPrometheusSampledTimers(t *testing.T) {
+	defer SetTimerHistograms(nil)
+	SetTimerHistograms(TimerHistograms{{"db.*", []float64{15}}})
+	prom, _ := NewPrometheus(nil)
+	snapshot := NewSnapshot()
+	snapshot.timerPercentiles = TimerPercentiles{90}
+	for _, key := range []string{"api.latency", "db.query"} {
+		snapshot.ProcessStatgram(Statgram{
+			Sample{key: key, value: 10, valueType: TIMER, sampleRate: 0.1},
+			Sample{key: key, value: 20, valueType: TIMER, sampleRate: 0.1},
+		})
+	}
+	prom.Flush(snapshot)
+
+	var buffer bytes.Buffer
+	prom.WriteMetrics(&buffer)
+	// _sum/_count is the mean, as both are scaled up by the sample rate
+	for _, line := range []string{
+		"api_latency_sum 300", "api_latency_count 20",
+		`db_query_bucket{le="15"} 10`, "db_query_sum 300", "db_query_count 20",
+	} {
+		if !strings.Contains(buffer.String(), line+"\n") {
+			t.Errorf("expected %s, got:\n%s", line, buffer.String())
+		}
+	}
+}
+
+func TestPrometheusDuplicateLabels(t *testing.T) {
+	defer SetTimerHistograms(nil)
+	SetTimerHistograms(TimerHistograms{{"db.*", []float64{10}}})
+	var mappings StatMappings
+	mappings.Set("api.*.requests=api_requests,endpoint=$1")
+	prom, _ := NewPrometheus(mappings)
+	snapshot := NewSnapshot()
+	snapshot.timerPercentiles = TimerPercentiles{90}
+	// the mapping's endpoint label is kept over the key's tag
+	snapshot.Count("api.users.requests;endpoint=other", 1)
+	// tags that sanitize to the same label name keep the first
+	snapshot.Gauge("queue.depth;a.b=1;a_b=2", 7)
+	// tags named after the labels summaries and histograms add are renamed
+	snapshot.Time("api.latency;quantile=x", 2)
+	snapshot.Time("db.query;le=y", 4)
+	prom.Flush(snapshot)
+
+	var buffer bytes.Buffer
+	prom.WriteMetrics(&buffer)
+	expected := strings.Join([]string{
+		"# TYPE api_latency summary",
+		`api_latency{exported_quantile="x",quantile="0.9"} 2`,
+		`api_latency_sum{exported_quantile="x"} 2`,
+		`api_latency_count{exported_quantile="x"} 1`,
+		"# TYPE api_requests_total counter",
+		`api_requests_total{endpoint="users"} 1`,
+		"# TYPE db_query histogram",
+		`db_query_bucket{exported_le="y",le="10"} 1`,
+		`db_query_bucket{exported_le="y",le="+Inf"} 1`,
+		`db_query_sum{exported_le="y"} 4`,
+		`db_query_count{exported_le="y"} 1`,
+		"# TYPE queue_depth gauge",
+		`queue_depth{a_b="1"} 7`,
+		"",
+	}, "\n")
+	if result := buffer.String(); result != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+}
+
+func TestPrometheusTypeConflict(t *testing.T) {
+	prom, _ := NewPrometheus(nil)
+	snapshot := NewSnapshot()
+	snapshot.Gauge("x_total", 1)
+	snapshot.Count("x", 1)
+	prom.Flush(snapshot)
+	var buffer bytes.Buffer
+	prom.WriteMetrics(&buffer)
+	// one of them is dropped, whichever came first is kept
+	if strings.Count(buffer.String(), "# TYPE") != 1 {
+		t.Errorf("expected one metric, got:\n%s", buffer.String())
+	}
+}
+
+func TestPrometheusServeHTTP(t *testing.T) {
+	prom, _ := NewPrometheus(nil)
+	snapshot := NewSnapshot()
+	snapshot.Gauge("x", 1)
+	prom.Flush(snapshot)
+	recorder := httptest.NewRecorder()
+	prom.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+		"text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	if body := recorder.Body.String(); body != "# TYPE x gauge\nx 1\n" {
+		t.Errorf("unexpected body %#v", body)
+	}
+}
+
+func TestPrometheusExpiry(t *testing.T) {
+	prom, err := NewPrometheus(nil, PrometheusExpiry(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := NewSnapshot()
+	snapshot.Count("idle", 1)
+	snapshot.Count("busy", 1)
+	snapshot.Count("busy;host=a", 1)
+	prom.Flush(snapshot)
+	snapshot.Flush()
+	snapshot.Count("busy", 1)
+	prom.Flush(snapshot)
+
+	var buffer bytes.Buffer
+	prom.WriteMetrics(&buffer)
+	if !strings.Contains(buffer.String(), "idle_total 1") {
+		t.Errorf("expected idle series before it expires, got:\n%s",
+			buffer.String())
+	}
+
+	prom.Flush(snapshot)
+	buffer.Reset()
+	prom.WriteMetrics(&buffer)
+	expected := "# TYPE busy_total counter\nbusy_total 3\n"
+	if result := buffer.String(); result != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+
+	if _, err = NewPrometheus(nil, ReusePort(true)); err == nil {
+		t.Error("expected an error for an invalid option")
+	}
+}
@@ -0,0 +1,480 @@
+package tally
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_REPORT_QUEUE_SIZE = 60
+	RETRY_MIN_BACKOFF         = time.Second
+	RETRY_MAX_BACKOFF         = time.Minute
+)
+
+// ReportQueueSize is a server option setting the most reports held for
+// delivery to each graphite destination while it's unavailable.
+type ReportQueueSize int
+
+// ReportQueue holds rendered reports until they're delivered to graphite, so
+// that the server can go on collecting stats while graphite is unavailable.
+// Each report is split between graphite's destinations as it's queued, and
+// each destination has its own lane of reports, delivered in order and retried
+// with exponential backoff independently of the others, so that a destination
+// that's down doesn't hold up the rest. If a lane fills up, its oldest reports
+// are moved to its spool if there is one, or dropped otherwise, to make room
+// for new ones. Spooled reports are delivered first, as they're older than any
+// in memory.
+//
+// A report may occasionally be delivered twice, if it's spooled while it's
+// being sent. Graphite keeps the last value received for a timestamp, so this
+// does no harm.
+type ReportQueue struct {
+	mu       sync.Mutex
+	lanes    map[string]*reportLane // by destination name
+	capacity int                    // of each lane
+	graphite *Graphite
+	spool    ReportSpool // Dir is empty if not configured
+	running  bool        // whether lanes are being delivered
+	retries  int64       // since last taken by TakeStats
+	dropped  int64       // since last taken by TakeStats
+
+	emptied chan struct{} // closed and replaced whenever the queue empties
+}
+
+// reportLane holds the reports awaiting delivery to one graphite destination.
+// Its destination and reports are guarded by the queue's lock.
+type reportLane struct {
+	name        string
+	destination *graphiteDestination
+	reports     []*[]byte
+	spool       *Spool // nil if not configured
+
+	pushed   chan struct{} // signals the lane's sender that a report is queued
+	retryNow chan struct{} // cuts short the sender's backoff
+	removed  chan struct{} // closed when the destination is no longer used
+}
+
+func NewReportQueue(graphite *Graphite, capacity int) *ReportQueue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	queue := &ReportQueue{
+		lanes:    make(map[string]*reportLane),
+		capacity: capacity,
+		emptied:  make(chan struct{}),
+	}
+	queue.SetGraphite(graphite)
+	return queue
+}
+
+// SetSpool enables spooling, with a spool for each destination in its own
+// subdirectory of the given one. Each spool is capped at MaxBytes.
+func (queue *ReportQueue) SetSpool(spool ReportSpool) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.spool = spool
+	for _, lane := range queue.lanes {
+		var err error
+		if lane.spool, err = queue.openSpool(lane.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openSpool opens the spool for a destination. Must be called with the lock
+// held.
+func (queue *ReportQueue) openSpool(name string) (*Spool, error) {
+	if queue.spool.Dir == "" {
+		return nil, nil
+	}
+	dir := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+	return OpenSpool(filepath.Join(queue.spool.Dir, dir), queue.spool.MaxBytes)
+}
+
+// spooling returns whether reports are spooled.
+func (queue *ReportQueue) spooling() bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.spool.Dir != ""
+}
+
+// Push queues a report for delivery, dropping the oldest report queued for a
+// destination if its lane is full. The report is dropped if there's no
+// graphite client to split it between destinations.
+func (queue *ReportQueue) Push(report []byte) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.graphite == nil {
+		queue.dropped++
+		errorlog("no graphite destinations, dropped report")
+		return
+	}
+	for i, share := range queue.graphite.split(report) {
+		if len(share) == 0 {
+			continue
+		}
+		share := share
+		lane := queue.lanes[queue.graphite.destinations[i].name]
+		if len(lane.reports) == queue.capacity {
+			queue.spoolOldest(lane)
+		}
+		lane.reports = append(lane.reports, &share)
+		notify(lane.pushed)
+	}
+}
+
+// spoolOldest moves a lane's oldest report in memory to its spool, or drops it
+// if there is no spool. Must be called with the lock held.
+func (queue *ReportQueue) spoolOldest(lane *reportLane) {
+	oldest := lane.reports[0]
+	lane.reports = lane.reports[1:]
+	if lane.spool == nil {
+		queue.dropped++
+		errorlog("graphite report queue for %s full, dropped oldest report",
+			lane.name)
+		return
+	}
+	dropped, err := lane.spool.Write(*oldest)
+	if err != nil {
+		errorlog("failed to spool report for %s: %s", lane.name, err)
+	}
+	if dropped > 0 {
+		queue.dropped += int64(dropped)
+		errorlog("graphite report spool for %s full, dropped %d reports",
+			lane.name, dropped)
+	}
+}
+
+// SpoolAll moves all the reports in memory to the spools, so that they can be
+// delivered after a restart. Does nothing if there's no spool.
+func (queue *ReportQueue) SpoolAll() {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for _, lane := range queue.lanes {
+		if lane.spool == nil {
+			continue
+		}
+		if len(lane.reports) > 0 {
+			infolog("spooling %d undelivered reports for %s",
+				len(lane.reports), lane.name)
+		}
+		for len(lane.reports) > 0 {
+			queue.spoolOldest(lane)
+		}
+	}
+}
+
+// The queue is registered with a server as its graphite backend.
+func (queue *ReportQueue) Name() string {
+	return "graphite"
+}
+
+// Flush renders a snapshot and queues it for delivery.
+func (queue *ReportQueue) Flush(snapshot SnapshotView) error {
+	infolog("queueing report of %d stats for graphite", snapshot.NumStats())
+	queue.Push(RenderReport(snapshot))
+	return nil
+}
+
+func (queue *ReportQueue) Status() string {
+	queue.mu.Lock()
+	graphite := queue.graphite
+	queue.mu.Unlock()
+	status := fmt.Sprintf("%d reports queued", queue.Len())
+	if queue.spooling() {
+		spooled, size := queue.SpoolStats()
+		status += fmt.Sprintf(", %d spooled (%d bytes)", spooled, size)
+	}
+	if graphite != nil {
+		status += "; " + graphite.Status()
+	}
+	return status
+}
+
+// Close closes the graphite client's connections. Reports still queued are
+// kept, in case there's a spool to move them to.
+func (queue *ReportQueue) Close() error {
+	queue.mu.Lock()
+	graphite := queue.graphite
+	queue.mu.Unlock()
+	if graphite != nil {
+		return graphite.Close()
+	}
+	return nil
+}
+
+// Len returns the number of reports awaiting delivery in memory to the
+// destination with the most.
+func (queue *ReportQueue) Len() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	longest := 0
+	for _, lane := range queue.lanes {
+		if len(lane.reports) > longest {
+			longest = len(lane.reports)
+		}
+	}
+	return longest
+}
+
+// SpoolStats returns the number of reports spooled for the destination with
+// the most, and the total size of the spools.
+func (queue *ReportQueue) SpoolStats() (reports int, size int64) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for _, lane := range queue.lanes {
+		if lane.spool == nil {
+			continue
+		}
+		spooled, spoolSize := lane.spool.Stats()
+		if spooled > reports {
+			reports = spooled
+		}
+		size += spoolSize
+	}
+	return
+}
+
+// TakeStats returns the number of failed deliveries that have been retried
+// and the number of reports dropped since the last call, counting each
+// destination's share of a report separately.
+func (queue *ReportQueue) TakeStats() (retries, dropped int64) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	retries, dropped = queue.retries, queue.dropped
+	queue.retries, queue.dropped = 0, 0
+	return
+}
+
+// SetGraphite changes the graphite client reports are delivered to, closing
+// the previous client's connection. Delivery of the queued reports is retried
+// immediately. Nothing changes if the new client has the same settings as the
+// current one, which goes on using its open connections.
+//
+// Destinations that both clients share keep their queued reports. The reports
+// queued in memory for a destination that's no longer used are dropped, but
+// those in its spool are left to be delivered if it's used again.
+func (queue *ReportQueue) SetGraphite(graphite *Graphite) {
+	queue.mu.Lock()
+	previous := queue.graphite
+	if previous.sameSettings(graphite) {
+		queue.mu.Unlock()
+		return
+	}
+	queue.graphite = graphite
+	lanes := make(map[string]*reportLane)
+	if graphite != nil {
+		for _, destination := range graphite.destinations {
+			lane, ok := queue.lanes[destination.name]
+			if ok {
+				delete(queue.lanes, destination.name)
+				notify(lane.retryNow)
+			} else {
+				lane = queue.newLane(destination.name)
+			}
+			lane.destination = destination
+			lanes[destination.name] = lane
+		}
+	}
+	for name, lane := range queue.lanes {
+		if len(lane.reports) > 0 {
+			queue.dropped += int64(len(lane.reports))
+			errorlog("dropped %d reports queued for removed graphite "+
+				"destination %s", len(lane.reports), name)
+		}
+		close(lane.removed)
+	}
+	queue.lanes = lanes
+	queue.checkEmpty()
+	queue.mu.Unlock()
+	if previous != nil {
+		// this waits for any report being sent to it
+		go previous.Close()
+	}
+}
+
+// newLane creates a lane for a destination, and starts delivering it if the
+// queue is running. Must be called with the lock held.
+func (queue *ReportQueue) newLane(name string) *reportLane {
+	lane := &reportLane{
+		name:     name,
+		pushed:   make(chan struct{}, 1),
+		retryNow: make(chan struct{}, 1),
+		removed:  make(chan struct{}),
+	}
+	var err error
+	if lane.spool, err = queue.openSpool(name); err != nil {
+		errorlog("reports for %s won't be spooled: %s", name, err)
+	}
+	if queue.running {
+		go queue.deliver(lane)
+	}
+	return lane
+}
+
+// Drain retries delivery immediately, then waits until the queue and spools
+// are empty. Returns an error if abort is closed first.
+func (queue *ReportQueue) Drain(abort <-chan struct{}) error {
+	queue.mu.Lock()
+	for _, lane := range queue.lanes {
+		notify(lane.retryNow)
+	}
+	queue.mu.Unlock()
+	for {
+		queue.mu.Lock()
+		empty, emptied := queue.empty(), queue.emptied
+		queue.mu.Unlock()
+		if empty {
+			return nil
+		}
+		select {
+		case <-emptied:
+		case <-abort:
+			return errors.New("reports still queued for graphite")
+		}
+	}
+}
+
+// empty returns whether there are no reports in memory or in the spools. Must
+// be called with the lock held.
+func (queue *ReportQueue) empty() bool {
+	for _, lane := range queue.lanes {
+		if len(lane.reports) > 0 {
+			return false
+		}
+		if lane.spool != nil {
+			if spooled, _ := lane.spool.Stats(); spooled > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkEmpty signals Drain if the queue is empty. Must be called with the lock
+// held.
+func (queue *ReportQueue) checkEmpty() {
+	if queue.empty() {
+		close(queue.emptied)
+		queue.emptied = make(chan struct{})
+	}
+}
+
+// next returns the oldest report in a lane, from its spool if it has any, and
+// the name of its segment if it's spooled.
+func (queue *ReportQueue) next(lane *reportLane) (report *[]byte,
+	segment string) {
+	for lane.spool != nil {
+		name, spooled, err := lane.spool.Oldest()
+		if err != nil {
+			errorlog("dropped unreadable spooled report for %s: %s",
+				lane.name, err)
+			queue.mu.Lock()
+			queue.dropped++
+			queue.mu.Unlock()
+			continue
+		}
+		if spooled == nil {
+			break
+		}
+		return &spooled, name
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if len(lane.reports) > 0 {
+		report = lane.reports[0]
+	}
+	return
+}
+
+// Run starts delivering queued reports, in order for each destination.
+func (queue *ReportQueue) Run() {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.running {
+		return
+	}
+	queue.running = true
+	for _, lane := range queue.lanes {
+		go queue.deliver(lane)
+	}
+}
+
+// deliver sends a lane's reports to its destination in order, until the
+// destination is removed.
+func (queue *ReportQueue) deliver(lane *reportLane) {
+	backoff := time.Duration(0)
+	for {
+		report, segment := queue.next(lane)
+		if report == nil {
+			select {
+			case <-lane.pushed:
+			case <-lane.removed:
+				return
+			}
+			continue
+		}
+		queue.mu.Lock()
+		graphite, destination := queue.graphite, lane.destination
+		queue.mu.Unlock()
+		select {
+		case <-lane.removed:
+			return
+		default:
+		}
+
+		infolog("sending report of %d bytes to graphite at %s", len(*report),
+			lane.name)
+		if err := graphite.sendTo(destination, *report); err != nil {
+			if backoff == 0 {
+				backoff = RETRY_MIN_BACKOFF
+			} else if backoff *= 2; backoff > RETRY_MAX_BACKOFF {
+				backoff = RETRY_MAX_BACKOFF
+			}
+			errorlog("failed to send graphite report to %s, retrying in %s: %s",
+				lane.name, backoff, err)
+			queue.mu.Lock()
+			queue.retries++
+			queue.mu.Unlock()
+			select {
+			case <-time.After(backoff):
+			case <-lane.retryNow:
+			case <-lane.removed:
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		if segment != "" {
+			lane.spool.Remove(segment)
+		}
+		queue.mu.Lock()
+		// the report may have been dropped while it was being sent
+		if len(lane.reports) > 0 && lane.reports[0] == report {
+			lane.reports = lane.reports[1:]
+		}
+		queue.checkEmpty()
+		queue.mu.Unlock()
+	}
+}
+
+// notify signals a goroutine waiting on a channel with a buffer of one,
+// without blocking if a notification is already pending.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
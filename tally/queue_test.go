@@ -0,0 +1,109 @@
+package tally
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// signalingFailDialer always fails, signaling each attempt.
+type signalingFailDialer chan bool
+
+func (dialer signalingFailDialer) Dial(*net.TCPAddr) (io.WriteCloser, error) {
+	dialer <- true
+	return nil, errors.New("this dialer always fails")
+}
+
+func TestReportQueueDropsOldest(t *testing.T) {
+	graphite, _ := NewGraphite("localhost:7", new(bufDialer))
+	queue := NewReportQueue(graphite, 2)
+	queue.Push([]byte("a"))
+	queue.Push([]byte("b"))
+	queue.Push([]byte("c"))
+	if queue.Len() != 2 {
+		t.Errorf("expected 2 queued reports, got %d", queue.Len())
+	}
+	reports := queue.lanes["localhost:7"].reports
+	if string(*reports[0]) != "b" || string(*reports[1]) != "c" {
+		t.Error("expected the oldest report to be dropped")
+	}
+	if _, dropped := queue.TakeStats(); dropped != 1 {
+		t.Errorf("expected 1 dropped report, got %d", dropped)
+	}
+	if _, dropped := queue.TakeStats(); dropped != 0 {
+		t.Errorf("expected stats to be reset, got %d dropped", dropped)
+	}
+}
+
+func TestReportQueueDelivery(t *testing.T) {
+	attempts := make(signalingFailDialer, 1)
+	failing, _ := NewGraphite("localhost:7", attempts)
+	dialer := new(bufDialer)
+	working, _ := NewGraphite("localhost:7", dialer)
+
+	queue := NewReportQueue(failing, 10)
+	go queue.Run()
+	queue.Push([]byte("x 1 0\n"))
+	<-attempts
+	// switching graphite cuts the backoff short
+	queue.SetGraphite(working)
+	queue.Push([]byte("y 2 0\n"))
+
+	abort := make(chan struct{})
+	timer := time.AfterFunc(5*time.Second, func() { close(abort) })
+	defer timer.Stop()
+	if err := queue.Drain(abort); err != nil {
+		t.Fatal(err)
+	}
+	if sent := dialer.buffer.String(); sent != "x 1 0\ny 2 0\n" {
+		t.Errorf("expected both reports in order, got %#v", sent)
+	}
+	if retries, _ := queue.TakeStats(); retries != 1 {
+		t.Errorf("expected 1 retry, got %d", retries)
+	}
+}
+
+func TestReportQueueDestinationDown(t *testing.T) {
+	dialer := new(addrDialer)
+	dialer.setDown("127.0.0.1:2004", true)
+	graphite, _ := NewGraphite("127.0.0.1:2003,127.0.0.1:2004", dialer)
+	queue := NewReportQueue(graphite, 10)
+	go queue.Run()
+	queue.Push([]byte("a 1 0\n"))
+	queue.Push([]byte("b 2 0\n"))
+
+	// the healthy destination gets every report without waiting for the other
+	deadline := time.Now().Add(5 * time.Second)
+	for dialer.sent()["127.0.0.1:2003"] != "a 1 0\nb 2 0\n" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both reports at the healthy destination, got %#v",
+				dialer.sent()["127.0.0.1:2003"])
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if queue.Len() != 2 {
+		t.Errorf("expected 2 reports queued for the failed destination, got %d",
+			queue.Len())
+	}
+
+	// the failed destination gets its reports once it recovers, and the
+	// healthy one doesn't get them again
+	dialer.setDown("127.0.0.1:2004", false)
+	abort := make(chan struct{})
+	timer := time.AfterFunc(5*time.Second, func() { close(abort) })
+	defer timer.Stop()
+	if err := queue.Drain(abort); err != nil {
+		t.Fatal(err)
+	}
+	if sent := dialer.sent()["127.0.0.1:2004"]; sent != "a 1 0\nb 2 0\n" {
+		t.Errorf("expected both reports in order, got %#v", sent)
+	}
+	if sent := dialer.sent()["127.0.0.1:2003"]; sent != "a 1 0\nb 2 0\n" {
+		t.Errorf("expected no repeated reports, got %#v", sent)
+	}
+	if retries, _ := queue.TakeStats(); retries == 0 {
+		t.Error("expected retries for the failed destination")
+	}
+}
@@ -3,17 +3,29 @@ package tally
 import (
 	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
 const (
 	STATGRAM_MAXSIZE = 10240
+	// RECV_BATCH_SIZE is the most datagrams read per syscall, on connections
+	// that support batched reads.
+	RECV_BATCH_SIZE = 32
 )
 
+// batchReader reads several datagrams per call. The returned datagrams are
+// only valid until the next call.
+type batchReader interface {
+	ReadBatch() ([][]byte, error)
+}
+
 // Receivers share the work of listening on a UDP port and accumulating stats.
 type Receiver struct {
 	id               string // child identifier for collecting internal stats
 	conn             io.Reader
+	batch            batchReader // nil if conn doesn't support batched reads
+	pending          [][]byte    // datagrams read in the last batch, not yet parsed
 	lastMessageCount int64
 	messageCount     int64
 	lastByteCount    int64
@@ -29,17 +41,37 @@ func NewReceiver() *Receiver {
 	}
 }
 
+// setConn sets the connection to read statgrams from, using batched reads if
+// the connection supports them.
+func (receiver *Receiver) setConn(conn io.Reader) {
+	receiver.conn = conn
+	receiver.batch = newBatchReader(conn)
+	receiver.pending = nil
+}
+
 // ReadOnce blocks on the listening connection until a statgram arrives. It
 // takes care of parsing it and returns it. Any parse errors are ignored, so
 // it's possible an empty statgram will be returned.
 func (receiver *Receiver) ReadOnce() (s Statgram, err error) {
-	var size int
-	size, err = receiver.conn.Read(receiver.readBuf)
-	if err == nil {
-		receiver.messageCount += 1
-		receiver.byteCount += int64(size)
-		s = receiver.parser.ParseStatgram(receiver.readBuf[:size])
+	var datagram []byte
+	if receiver.batch != nil {
+		for len(receiver.pending) == 0 {
+			if receiver.pending, err = receiver.batch.ReadBatch(); err != nil {
+				return
+			}
+		}
+		datagram = receiver.pending[0]
+		receiver.pending = receiver.pending[1:]
+	} else {
+		var size int
+		if size, err = receiver.conn.Read(receiver.readBuf); err != nil {
+			return
+		}
+		datagram = receiver.readBuf[:size]
 	}
+	receiver.messageCount += 1
+	receiver.byteCount += int64(len(datagram))
+	s = receiver.parser.ParseStatgram(datagram)
 	return
 }
 
@@ -74,35 +106,59 @@ func (receiver *Receiver) ReceiveStatgrams() (statgrams chan Statgram) {
 
 // RunReceiver spins off a goroutine to receive and process statgrams. Returns a
 // bidirectional control channel, which provides a snapshot each time it's given
-// a nil value.
+// a nil value. This continues after the connection is closed, so the last
+// statgrams read from it can be collected.
 //
 // An optional channel for notification of processed statgrams may be passed in
 // to facilitate testing.
 func RunReceiver(id string, conn io.Reader,
+	notifiers ...chan Statgram) (controlChannel chan *Snapshot) {
+	return runReceiver(id, conn, nil, nil, nil, notifiers...)
+}
+
+// runReceiver is like RunReceiver, but also processes statgrams arriving on
+// the given stream channel, which may be shared with other receivers. If
+// drained is given, it's marked done once the connection and stream channel
+// are both closed and every statgram from them has been processed. If a
+// repeater is given, statgrams are passed to it as well.
+func runReceiver(id string, conn io.Reader, stream chan Statgram,
+	repeater *Repeater, drained *sync.WaitGroup,
 	notifiers ...chan Statgram) (controlChannel chan *Snapshot) {
 	receiver := NewReceiver()
 	receiver.id = id
-	receiver.conn = conn
+	receiver.setConn(conn)
 	snapshot := NewSnapshot()
 	controlChannel = make(chan *Snapshot)
 	statgrams := receiver.ReceiveStatgrams()
-	closed := false
+	process := func(statgram Statgram) {
+		if repeater != nil {
+			repeater.Repeat(statgram)
+		}
+		if repeater == nil || !repeater.repeatOnly {
+			snapshot.ProcessStatgram(statgram)
+		}
+		for _, notifier := range notifiers {
+			notifier <- statgram
+		}
+	}
 	go func() {
 		for {
+			// a nil channel is never ready, so closed inputs drop out of
+			// the select
 			select {
 			case statgram, ok := <-statgrams:
 				if !ok {
 					infolog("EOF received")
-					closed = true
-					if snapshot.NumStats() == 0 {
-						close(controlChannel)
-						break
-					}
+					statgrams = nil
+					break
 				}
-				snapshot.ProcessStatgram(statgram)
-				for _, notifier := range notifiers {
-					notifier <- statgram
+				process(statgram)
+			case statgram, ok := <-stream:
+				if !ok {
+					stream = nil
+					break
 				}
+				process(statgram)
 			case _ = <-controlChannel:
 				snapshot.Count("tallier.messages.child_"+receiver.id,
 					float64(receiver.messageCount-receiver.lastMessageCount))
@@ -111,12 +167,11 @@ func RunReceiver(id string, conn io.Reader,
 				receiver.lastMessageCount = receiver.messageCount
 				receiver.lastByteCount = receiver.byteCount
 				controlChannel <- snapshot
-				if closed {
-					close(controlChannel)
-					break
-				} else {
-					snapshot = NewSnapshot()
-				}
+				snapshot = NewSnapshot()
+			}
+			if statgrams == nil && stream == nil && drained != nil {
+				drained.Done()
+				drained = nil
 			}
 		}
 	}()
@@ -124,14 +179,31 @@ func RunReceiver(id string, conn io.Reader,
 }
 
 // Aggregate spins off receivers and a goroutine to manage them. Returns a
-// channel to coordinate the collection of snapshots from the receivers.
-func Aggregate(conn io.Reader, numReceivers int) (snapchan chan *Snapshot) {
+// channel to coordinate the collection of snapshots from the receivers. The
+// receivers are assigned to the given connections in turn, so there may be one
+// connection shared by all, or one for each. The receivers also share the work
+// of processing statgrams from stream connections, if a stream channel is
+// given, and of passing statgrams to the repeater, if one is given.
+//
+// Also returns a channel that's closed once the receivers have processed
+// everything from the connections and stream channel, after these have all
+// been closed. A snapshot collected after that is the last with any stats.
+func Aggregate(conns []io.Reader, stream chan Statgram, repeater *Repeater,
+	numReceivers int) (snapchan chan *Snapshot, drained chan struct{}) {
 	snapchan = make(chan *Snapshot)
+	drained = make(chan struct{})
 	var controlChannels []chan *Snapshot
+	var wg sync.WaitGroup
+	wg.Add(numReceivers)
 	for i := 0; i < numReceivers; i++ {
 		controlChannels = append(controlChannels,
-			RunReceiver(fmt.Sprintf("%d", i), conn))
+			runReceiver(fmt.Sprintf("%d", i), conns[i%len(conns)], stream,
+				repeater, &wg))
 	}
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
 
 	go func() {
 		var numStats int64 = 0
@@ -12,7 +12,8 @@ import (
 func TestReceiveOnce(t *testing.T) {
 	receiver := NewReceiver()
 	receiver.conn = bytes.NewBufferString("x:1|c")
-	expected := Statgram{Sample{"x", 1.0, COUNTER, 1.0, ""}}
+	expected := Statgram{
+		Sample{key: "x", value: 1.0, valueType: COUNTER, sampleRate: 1.0}}
 
 	statgram, err := receiver.ReadOnce()
 	if err != nil {
@@ -55,14 +56,16 @@ func TestReceiveStatgrams(t *testing.T) {
 	statgrams := receiver.ReceiveStatgrams()
 
 	conn.Write([]byte("x:1.0|c"))
-	expected := Statgram{Sample{"x", 1.0, COUNTER, 1.0, ""}}
+	expected := Statgram{
+		Sample{key: "x", value: 1.0, valueType: COUNTER, sampleRate: 1.0}}
 	statgram := <-statgrams
 	if s, ok := assertDeepEqual(expected, statgram); !ok {
 		t.Error(s)
 	}
 
 	conn.Write([]byte("y:2.0|ms@0.5"))
-	expected = Statgram{Sample{"y", 2.0, TIMER, 0.5, ""}}
+	expected = Statgram{
+		Sample{key: "y", value: 2.0, valueType: TIMER, sampleRate: 0.5}}
 	statgram = <-statgrams
 	if s, ok := assertDeepEqual(expected, statgram); !ok {
 		t.Error(s)
@@ -92,6 +95,63 @@ func TestRunReceiver(t *testing.T) {
 	}
 }
 
+func TestRunReceiverWithStream(t *testing.T) {
+	expected := NewSnapshot()
+	expected.Count("x", 1)
+	expected.Count("y", 2)
+	expected.Count("tallier.messages.child_test", 1)
+	expected.Count("tallier.bytes.child_test", float64(len("x:1.0|c")))
+	expected.CountString("tallier.samples", "x", 1)
+	expected.CountString("tallier.samples", "y", 1)
+
+	notifier := make(chan Statgram)
+	conn := make(CoordinatedReader)
+	stream := make(chan Statgram)
+	control := runReceiver("test", &conn, stream, nil, nil, notifier)
+
+	conn.Write([]byte("x:1.0|c"))
+	<-notifier
+	stream <- Statgram{
+		Sample{key: "y", value: 2.0, valueType: COUNTER, sampleRate: 1.0}}
+	<-notifier
+	control <- nil
+	snapshot := <-control
+	if s, ok := assertDeepEqual(expected, snapshot); !ok {
+		t.Error(s)
+	}
+}
+
+func TestAggregateDrained(t *testing.T) {
+	expected := NewSnapshot()
+	expected.Count("x", 1)
+	expected.Count("y", 2)
+	expected.Count("tallier.messages.child_0", 1)
+	expected.Count("tallier.messages.total", 1)
+	expected.Count("tallier.bytes.child_0", float64(len("x:1.0|c")))
+	expected.Count("tallier.bytes.total", float64(len("x:1.0|c")))
+	expected.CountString("tallier.samples", "x", 1)
+	expected.CountString("tallier.samples", "y", 1)
+	expected.numChildren = 1
+
+	conn := make(CoordinatedReader)
+	stream := make(chan Statgram)
+	snapchan, drained := Aggregate([]io.Reader{&conn}, stream, nil, 1)
+
+	conn.Write([]byte("x:1.0|c"))
+	stream <- Statgram{
+		Sample{key: "y", value: 2.0, valueType: COUNTER, sampleRate: 1.0}}
+	conn.Close()
+	close(stream)
+	<-drained
+
+	snapchan <- NewSnapshot()
+	snapshot := <-snapchan
+	snapshot.duration = 0
+	if s, ok := assertDeepEqual(expected, snapshot); !ok {
+		t.Error(s)
+	}
+}
+
 func BenchmarkRunReceiver(b *testing.B) {
 	bs := []byte("x:1|c:2|c\ny:1|m@0.5:e\ns:0|s|a\\nb\\&c\\\\d\\;e\nz:0.1|c")
 	var ms runtime.MemStats
@@ -0,0 +1,125 @@
+package tally
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReloadStatus describes the outcome of a configuration reload, for the status
+// page.
+type ReloadStatus struct {
+	Time            time.Time
+	Error           string   `json:",omitempty"`
+	Applied         []string `json:",omitempty"` // settings changed
+	RequiresRestart []string `json:",omitempty"` // changes not yet in effect
+}
+
+// serverSettings are the settings of a running server that may be reloaded.
+// Zero values leave a setting unchanged, except for harold, which is disabled
+// if nil. The graphite and harold clients only replace the server's if their
+// settings differ, so that connections and heartbeats aren't interrupted.
+type serverSettings struct {
+	flushInterval    time.Duration
+	graphite         *Graphite
+	harold           *Harold
+	timerPercentiles TimerPercentiles
+	tagFormat        *TagFormat
+	shutdownTimeout  time.Duration
+}
+
+// Reload changes the settings of a running server. The flush interval, the
+// graphite and harold clients, and the TimerPercentiles, TagFormat, and
+// ShutdownTimeout options may be changed; other options only take effect when
+// given to NewServer. The changes are applied by the server loop between
+// flushes, so stats aren't lost.
+func (server *Server) Reload(flushInterval time.Duration, graphite *Graphite,
+	harold *Harold, options ...interface{}) error {
+	if flushInterval <= 0 {
+		return errors.New("flush interval must be positive")
+	}
+	settings := serverSettings{
+		flushInterval: flushInterval,
+		graphite:      graphite,
+		harold:        harold,
+	}
+	for _, option := range options {
+		switch option.(type) {
+		case TimerPercentiles:
+			settings.timerPercentiles = option.(TimerPercentiles)
+		case TagFormat:
+			tagFormat := option.(TagFormat)
+			settings.tagFormat = &tagFormat
+		case ShutdownTimeout:
+			settings.shutdownTimeout = time.Duration(option.(ShutdownTimeout))
+		default:
+			return errors.New(fmt.Sprintf("server option %T can't be reloaded",
+				option))
+		}
+	}
+	select {
+	case server.reloads <- settings:
+		return nil
+	case <-server.stopping:
+		return errors.New("server is stopping")
+	}
+}
+
+// applySettings is called by the server loop to apply reloaded settings.
+func (server *Server) applySettings(settings serverSettings) {
+	if settings.flushInterval != server.flushInterval {
+		server.flushInterval = settings.flushInterval
+		server.ticker.Reset(settings.flushInterval)
+	}
+	server.queue.SetGraphite(settings.graphite)
+	if !settings.harold.sameSettings(server.harold) {
+		if server.heartbeats != nil {
+			close(server.heartbeats)
+			server.heartbeats = nil
+		}
+		server.harold = settings.harold
+		if server.harold != nil {
+			server.heartbeats = server.harold.HeartMonitor("tallier")
+		}
+	}
+	if settings.timerPercentiles != nil {
+		server.timerPercentiles = settings.timerPercentiles
+		server.snapshot.timerPercentiles = settings.timerPercentiles
+	}
+	if settings.tagFormat != nil {
+		server.tagFormat = *settings.tagFormat
+		server.snapshot.tagFormat = *settings.tagFormat
+	}
+	if settings.shutdownTimeout != 0 {
+		server.shutdownTimeout = settings.shutdownTimeout
+	}
+}
+
+// SetReloadStatus logs the outcome of a configuration reload, and records it
+// to be shown on the status page.
+func (server *Server) SetReloadStatus(status ReloadStatus) {
+	if status.Error != "" {
+		errorlog("configuration reload failed: %s", status.Error)
+	} else if len(status.Applied) > 0 {
+		infolog("configuration reloaded, changed: %s",
+			strings.Join(status.Applied, ", "))
+	} else {
+		infolog("configuration reloaded, no changes")
+	}
+	if len(status.RequiresRestart) > 0 {
+		infolog("changes requiring a restart: %s",
+			strings.Join(status.RequiresRestart, ", "))
+	}
+	server.statusLock.Lock()
+	defer server.statusLock.Unlock()
+	server.reloadStatus = status
+}
+
+// LastReload returns the outcome of the last configuration reload. The time is
+// zero if there hasn't been one.
+func (server *Server) LastReload() ReloadStatus {
+	server.statusLock.Lock()
+	defer server.statusLock.Unlock()
+	return server.reloadStatus
+}
@@ -0,0 +1,101 @@
+package tally
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReloadInvalid(t *testing.T) {
+	server, err := NewServer("", 0, 1, time.Second, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Reload(time.Second, nil, nil, ReusePort(true)); err == nil {
+		t.Error("expected an error reloading a listener option")
+	}
+	if err = server.Reload(0, nil, nil); err == nil {
+		t.Error("expected an error reloading a zero flush interval")
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	server, err := NewServer("", 0, 1, time.Second, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ticker = time.NewTicker(server.flushInterval)
+	defer server.ticker.Stop()
+	server.snapshot = NewSnapshot()
+	graphite, _ := NewGraphite("127.0.0.1:2003")
+	tagFormat := TAGS_AS_PATH
+
+	server.applySettings(serverSettings{
+		flushInterval:    time.Minute,
+		graphite:         graphite,
+		timerPercentiles: TimerPercentiles{50},
+		tagFormat:        &tagFormat,
+	})
+	if server.flushInterval != time.Minute {
+		t.Errorf("expected flush interval 1m, got %s", server.flushInterval)
+	}
+	if server.queue.graphite != graphite {
+		t.Error("expected graphite client to be replaced")
+	}
+	if s, ok := assertDeepEqual(TimerPercentiles{50},
+		server.snapshot.timerPercentiles); !ok {
+		t.Error(s)
+	}
+	if server.snapshot.tagFormat != TAGS_AS_PATH {
+		t.Error("expected tag format to be changed")
+	}
+	if server.shutdownTimeout != DEFAULT_SHUTDOWN_TIMEOUT {
+		t.Errorf("expected shutdown timeout to be unchanged, got %s",
+			server.shutdownTimeout)
+	}
+}
+
+func TestApplyUnchangedSettings(t *testing.T) {
+	graphite, _ := NewGraphite("127.0.0.1:2003,127.0.0.1:2004",
+		ROUTE_CONSISTENT_HASHING)
+	harold, _ := NewHarold("http://harold", "secret")
+	server, err := NewServer("", 0, 1, time.Second, graphite, harold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ticker = time.NewTicker(server.flushInterval)
+	defer server.ticker.Stop()
+	server.snapshot = NewSnapshot()
+	server.heartbeats = harold.HeartMonitor("tallier")
+	heartbeats := server.heartbeats
+
+	// a reload builds new clients from the same flags
+	sameGraphite, _ := NewGraphite("127.0.0.1:2003,127.0.0.1:2004",
+		ROUTE_CONSISTENT_HASHING)
+	sameHarold, _ := NewHarold("http://harold", "secret")
+	server.applySettings(serverSettings{
+		flushInterval: time.Second,
+		graphite:      sameGraphite,
+		harold:        sameHarold,
+	})
+	if server.queue.graphite != graphite {
+		t.Error("expected graphite client to be kept")
+	}
+	if server.harold != harold || server.heartbeats != heartbeats {
+		t.Error("expected harold client and heartbeats to be kept")
+	}
+
+	otherGraphite, _ := NewGraphite("127.0.0.1:2003,127.0.0.1:2004")
+	otherHarold, _ := NewHarold("http://harold", "other secret")
+	server.applySettings(serverSettings{
+		flushInterval: time.Second,
+		graphite:      otherGraphite,
+		harold:        otherHarold,
+	})
+	if server.queue.graphite != otherGraphite {
+		t.Error("expected graphite client with new routing to replace the old")
+	}
+	if server.harold != otherHarold || server.heartbeats == heartbeats {
+		t.Error("expected harold client with new secret to replace the old")
+	}
+	close(server.heartbeats)
+}
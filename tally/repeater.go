@@ -0,0 +1,373 @@
+package tally
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_REPEATER_MTU leaves room for IP and UDP headers in a jumbo-free
+	// ethernet frame, as statsd's repeater does.
+	DEFAULT_REPEATER_MTU            = 1432
+	DEFAULT_REPEATER_FLUSH_INTERVAL = 100 * time.Millisecond
+	REPEATER_TCP_RETRIES            = 3
+	REPEATER_TIMEOUT                = 5 * time.Second
+	// REPEATER_MAX_PREFIX is the longest prefix a line can share with the one
+	// before it, as its length is given in two hex digits.
+	REPEATER_MAX_PREFIX = 0xff
+)
+
+// RepeaterMTU is a repeater option setting the most bytes in each datagram,
+// unless a single line is longer.
+type RepeaterMTU int
+
+// RepeaterFlushInterval is a repeater option setting the longest time samples
+// may wait to fill a datagram before it's sent.
+type RepeaterFlushInterval time.Duration
+
+// RepeatOnly is a repeater option that stops samples being aggregated
+// locally, so that they're only forwarded.
+type RepeatOnly bool
+
+// Repeater forwards the samples received by a server to upstream statsd (or
+// tallier) servers, given as "udp://<HOST>:<PORT>" or "tcp://<HOST>:<PORT>"
+// (a bare "<HOST>:<PORT>" means UDP). Every destination gets every sample.
+//
+// Samples are re-encoded into datagrams of at most the MTU. Consecutive
+// samples with the same key and tags share a line, and each line after the
+// first in a datagram is prefix-compressed against the one before it, with
+// '^' followed by the length of the shared prefix in two hex digits. A
+// datagram is sent once it's full, or after the flush interval.
+//
+// A repeater is also a backend, so that it's listed on the status page and
+// closed with the other backends when the server stops.
+type Repeater struct {
+	mtu           int
+	repeatOnly    bool
+	destinations  []*repeaterDestination
+	stopping      chan struct{} // closed by Close
+	stopped       chan struct{} // closed when the flush goroutine has finished
+	stopOnce      sync.Once
+	flushInterval time.Duration
+
+	mu       sync.Mutex // for everything below
+	datagram []byte     // being filled
+	line     []byte     // being encoded
+	previous []byte     // the last line in datagram, uncompressed
+	samples  int64      // repeated
+}
+
+type repeaterDestination struct {
+	*batchSender
+	address string
+	udpConn net.Conn      // nil if using tcp
+	stream  *streamWriter // nil if using udp, only used by the sender
+}
+
+func NewRepeater(addresses string,
+	options ...interface{}) (repeater *Repeater, err error) {
+	repeater = &Repeater{
+		mtu:           DEFAULT_REPEATER_MTU,
+		flushInterval: DEFAULT_REPEATER_FLUSH_INTERVAL,
+		stopping:      make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	for _, option := range options {
+		switch option.(type) {
+		case RepeaterMTU:
+			repeater.mtu = int(option.(RepeaterMTU))
+		case RepeaterFlushInterval:
+			repeater.flushInterval = time.Duration(
+				option.(RepeaterFlushInterval))
+		case RepeatOnly:
+			repeater.repeatOnly = bool(option.(RepeatOnly))
+		default:
+			err = errors.New(fmt.Sprintf("invalid repeater option %T", option))
+			return
+		}
+	}
+	if repeater.mtu < 1 {
+		repeater.mtu = DEFAULT_REPEATER_MTU
+	}
+	if repeater.flushInterval <= 0 {
+		repeater.flushInterval = DEFAULT_REPEATER_FLUSH_INTERVAL
+	}
+	for _, address := range strings.Split(addresses, ",") {
+		var destination *repeaterDestination
+		if destination, err = newRepeaterDestination(
+			strings.TrimSpace(address)); err != nil {
+			repeater.closeConns()
+			return
+		}
+		repeater.destinations = append(repeater.destinations, destination)
+	}
+	for _, destination := range repeater.destinations {
+		go destination.run()
+	}
+	go repeater.run()
+	return
+}
+
+func newRepeaterDestination(address string) (*repeaterDestination, error) {
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New(fmt.Sprintf(
+			"repeater address has no host: %s", address))
+	}
+	destination := &repeaterDestination{address: u.Host}
+	switch u.Scheme {
+	case "udp":
+		if destination.udpConn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, err
+		}
+		// a lost datagram isn't worth holding up the rest for
+		destination.batchSender = newBatchSender(u.Host, 0,
+			destination.send)
+	case "tcp":
+		destination.stream = &streamWriter{
+			address: u.Host, timeout: REPEATER_TIMEOUT}
+		destination.batchSender = newBatchSender(u.Host,
+			REPEATER_TCP_RETRIES, destination.send)
+	default:
+		return nil, errors.New(fmt.Sprintf(
+			"repeater address must be a udp or tcp url: %s", address))
+	}
+	return destination, nil
+}
+
+// send makes one attempt to deliver a datagram.
+func (destination *repeaterDestination) send(batch []byte) (retry bool,
+	err error) {
+	if destination.udpConn != nil {
+		_, err = destination.udpConn.Write(batch)
+		return false, err
+	}
+	return true, destination.stream.write(batch)
+}
+
+func (repeater *Repeater) Name() string {
+	return "repeater"
+}
+
+// Repeat encodes the samples of a statgram for forwarding. It's safe to call
+// from several goroutines, and doesn't keep any reference to the statgram.
+func (repeater *Repeater) Repeat(statgram Statgram) {
+	repeater.mu.Lock()
+	defer repeater.mu.Unlock()
+	for i := 0; i < len(statgram); {
+		first := &statgram[i]
+		line := append(repeater.line[:0], first.key...)
+		tagsLen := 0
+		if first.tags != "" {
+			tagsLen = len(first.tags) + 2
+		}
+		for n := 0; i < len(statgram) && statgram[i].key == first.key &&
+			statgram[i].tags == first.tags; n++ {
+			mark := len(line)
+			line = append(line, ':')
+			line = appendSample(line, &statgram[i])
+			if n > 0 && len(line)+tagsLen > MAX_LINE_LEN {
+				line = line[:mark]
+				break
+			}
+			i++
+			repeater.samples++
+		}
+		line = appendTags(line, first.tags)
+		repeater.addLine(line)
+		repeater.line = line
+	}
+}
+
+// addLine adds a line to the datagram being filled, prefix-compressed against
+// the line before it, first sending the datagram if there's no room left.
+func (repeater *Repeater) addLine(line []byte) {
+	encoded := repeater.compress(line)
+	if len(repeater.datagram) > 0 &&
+		len(repeater.datagram)+len(encoded)+1 > repeater.mtu {
+		repeater.sendDatagram()
+		encoded = line
+	}
+	repeater.datagram = append(repeater.datagram, encoded...)
+	repeater.datagram = append(repeater.datagram, '\n')
+	repeater.previous = append(repeater.previous[:0], line...)
+}
+
+// compress returns a line prefix-compressed against the previous line in the
+// datagram, if that makes it shorter, and the parser can decode it. The parser
+// unescapes the previous line in place before taking a prefix from it, so the
+// prefix has to end before the previous line's first escape.
+func (repeater *Repeater) compress(line []byte) []byte {
+	if len(repeater.datagram) == 0 || len(line) > MAX_LINE_LEN {
+		return line
+	}
+	n := 0
+	for n < REPEATER_MAX_PREFIX && n < len(line) &&
+		n < len(repeater.previous) && line[n] == repeater.previous[n] &&
+		repeater.previous[n] != '\\' {
+		n++
+	}
+	if n <= 3 {
+		return line
+	}
+	encoded := make([]byte, 0, len(line)-n+3)
+	encoded = append(encoded, '^', hexDigits[n>>4], hexDigits[n&0xf])
+	return append(encoded, line[n:]...)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// sendDatagram queues the datagram being filled for each destination. It must
+// be called with the lock held.
+func (repeater *Repeater) sendDatagram() {
+	if len(repeater.datagram) == 0 {
+		return
+	}
+	datagram := append([]byte(nil), repeater.datagram...)
+	for _, destination := range repeater.destinations {
+		destination.queue([][]byte{datagram})
+	}
+	repeater.datagram = repeater.datagram[:0]
+	repeater.previous = repeater.previous[:0]
+}
+
+// run sends the datagram being filled at each flush interval, until the
+// repeater is closed.
+func (repeater *Repeater) run() {
+	defer close(repeater.stopped)
+	ticker := time.NewTicker(repeater.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			repeater.mu.Lock()
+			repeater.sendDatagram()
+			repeater.mu.Unlock()
+		case <-repeater.stopping:
+			return
+		}
+	}
+}
+
+// Flush sends the datagram being filled. The snapshot is ignored, as samples
+// are repeated as they're received.
+func (repeater *Repeater) Flush(snapshot SnapshotView) error {
+	repeater.mu.Lock()
+	defer repeater.mu.Unlock()
+	repeater.sendDatagram()
+	return nil
+}
+
+func (repeater *Repeater) Status() string {
+	repeater.mu.Lock()
+	statuses := []string{fmt.Sprintf("%d samples repeated", repeater.samples)}
+	repeater.mu.Unlock()
+	for _, destination := range repeater.destinations {
+		statuses = append(statuses, fmt.Sprintf("%s: %s",
+			destination.address, destination.status()))
+	}
+	return strings.Join(statuses, "; ")
+}
+
+// Close sends the datagram being filled, and returns once each datagram still
+// queued has been sent or has failed.
+func (repeater *Repeater) Close() error {
+	repeater.stopOnce.Do(func() {
+		close(repeater.stopping)
+	})
+	<-repeater.stopped
+	repeater.Flush(nil)
+	for _, destination := range repeater.destinations {
+		destination.close()
+	}
+	return repeater.closeConns()
+}
+
+func (repeater *Repeater) closeConns() (err error) {
+	for _, destination := range repeater.destinations {
+		var closeErr error
+		if destination.udpConn != nil {
+			closeErr = destination.udpConn.Close()
+		} else {
+			closeErr = destination.stream.close()
+		}
+		if closeErr != nil {
+			err = closeErr
+		}
+	}
+	return
+}
+
+var sampleStringEscaper = strings.NewReplacer(
+	`\`, `\\`, "|", `\&`, ":", `\;`, "\n", `\n`)
+
+// appendSample encodes a sample's value, type, sample rate and string, in the
+// form ParseSample decodes.
+func appendSample(b []byte, sample *Sample) []byte {
+	switch sample.valueType {
+	case SET:
+		b = append(b, sampleStringEscaper.Replace(sample.stringValue)...)
+		b = append(b, "|u"...)
+	case GAUGE:
+		value := sample.value
+		if !sample.delta && value == 0 {
+			value = 0 // not -0, which would be an adjustment
+		}
+		if !sample.delta && value < 0 {
+			// a sign would make it an adjustment, so set it to zero first
+			b = append(b, "0|g:"...)
+		} else if sample.delta && !math.Signbit(value) {
+			b = append(b, '+')
+		}
+		b = strconv.AppendFloat(b, value, 'g', -1, 64)
+		b = append(b, "|g"...)
+	default:
+		b = strconv.AppendFloat(b, sample.value, 'g', -1, 64)
+		switch sample.valueType {
+		case COUNTER:
+			b = append(b, "|c"...)
+		case TIMER:
+			b = append(b, "|ms"...)
+		case STRING:
+			b = append(b, "|s"...)
+		}
+	}
+	if sample.sampleRate != 1 {
+		b = append(b, '@')
+		b = strconv.AppendFloat(b, sample.sampleRate, 'g', -1, 64)
+	}
+	if sample.valueType == STRING && sample.stringValue != "" {
+		b = append(b, '|')
+		b = append(b, sampleStringEscaper.Replace(sample.stringValue)...)
+	}
+	return b
+}
+
+// appendTags encodes tags in their canonical form ("route=/api;status=200")
+// as a DogStatsD-style tag section ("|#route:/api,status:200").
+func appendTags(b []byte, tags string) []byte {
+	if tags == "" {
+		return b
+	}
+	b = append(b, "|#"...)
+	for i, tag := range strings.Split(tags, ";") {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, strings.Replace(tag, "=", ":", 1)...)
+	}
+	return b
+}
@@ -0,0 +1,200 @@
+package tally
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenRepeaterUDP(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func receiveDatagram(t *testing.T, conn net.PacketConn) []byte {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, STATGRAM_MAXSIZE)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b[:n]
+}
+
+func TestRepeaterEncoding(t *testing.T) {
+	conn := listenRepeaterUDP(t)
+	defer conn.Close()
+	repeater, err := NewRepeater(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repeater.Close()
+	input := "api.requests:1|c:2|c@0.5\n" +
+		"api.requests.errors:3|c|#status:500,route:/x\n" +
+		"db.query:4|ms\n" +
+		"gauge:+2|g:-1|g:7|g\n" +
+		"paths:1|s|a\\&b\\;c\n" +
+		"users:alice|u"
+	statgram := NewStatgramParser().ParseStatgram([]byte(input))
+	repeater.Repeat(statgram)
+	repeater.Flush(nil)
+
+	datagram := receiveDatagram(t, conn)
+	expected := "api.requests:1|c:2|c@0.5\n" +
+		"^0c.errors:3|c|#route:/x,status:500\n" +
+		"db.query:4|ms\n" +
+		"gauge:+2|g:-1|g:7|g\n" +
+		"paths:1|s|a\\&b\\;c\n" +
+		"users:alice|u\n"
+	if string(datagram) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, datagram)
+	}
+	repeated := NewStatgramParser().ParseStatgram(datagram)
+	if s, ok := assertDeepEqual(statgram, repeated); !ok {
+		t.Error(s)
+	}
+}
+
+func TestRepeaterEscapedPrefix(t *testing.T) {
+	conn := listenRepeaterUDP(t)
+	defer conn.Close()
+	repeater, err := NewRepeater(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repeater.Close()
+	// consecutive lines that only differ after an escape in the value
+	input := "users:alice\\;x|u|#shard:1\n" +
+		"users:alice\\;x|u|#shard:2\n" +
+		"users:alice\\&y|u|#shard:3\n" +
+		"paths:1|s|a\\&b\\\\c|#shard:1\n" +
+		"paths:1|s|a\\&b\\\\c|#shard:2"
+	statgram := NewStatgramParser().ParseStatgram([]byte(input))
+	if len(statgram) != 5 {
+		t.Fatalf("expected 5 samples, got %d", len(statgram))
+	}
+	repeater.Repeat(statgram)
+	repeater.Flush(nil)
+
+	datagram := receiveDatagram(t, conn)
+	repeated := NewStatgramParser().ParseStatgram(datagram)
+	if s, ok := assertDeepEqual(statgram, repeated); !ok {
+		t.Errorf("%s\ndatagram:\n%s", s, datagram)
+	}
+}
+
+func TestAppendSampleNegativeGauge(t *testing.T) {
+	sample := Sample{key: "x", value: -5, valueType: GAUGE, sampleRate: 1}
+	if b := appendSample(nil, &sample); string(b) != "0|g:-5|g" {
+		t.Errorf("unexpected encoding %#v", string(b))
+	}
+	snapshot := NewSnapshot()
+	snapshot.Gauge("x", 3)
+	snapshot.ProcessStatgram(
+		NewStatgramParser().ParseStatgram([]byte("x:0|g:-5|g")))
+	if snapshot.gauges["x"].value != -5 {
+		t.Errorf("expected -5, got %v", snapshot.gauges["x"].value)
+	}
+}
+
+func TestRepeaterMTU(t *testing.T) {
+	conn := listenRepeaterUDP(t)
+	defer conn.Close()
+	repeater, err := NewRepeater("udp://"+conn.LocalAddr().String(),
+		RepeaterMTU(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repeater.Close()
+	var statgram Statgram
+	for i := 0; i < 100; i++ {
+		statgram = append(statgram, Sample{key: "some.long.stat.name." +
+			string(rune('a'+i%26)), value: float64(i), valueType: TIMER,
+			sampleRate: 1})
+	}
+	repeater.Repeat(statgram)
+	repeater.Flush(nil)
+
+	var repeated Statgram
+	for len(repeated) < len(statgram) {
+		datagram := receiveDatagram(t, conn)
+		if len(datagram) > 100 {
+			t.Errorf("datagram of %d bytes exceeds the mtu", len(datagram))
+		}
+		repeated = append(repeated,
+			NewStatgramParser().ParseStatgram(datagram)...)
+	}
+	if s, ok := assertDeepEqual(statgram, repeated); !ok {
+		t.Error(s)
+	}
+}
+
+func TestRepeaterTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	repeater, err := NewRepeater("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	statgram := NewStatgramParser().ParseStatgram(
+		[]byte("x.y.z:1|c\nx.y.zz:2|c"))
+	repeater.Repeat(statgram)
+	repeater.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	parser := NewStatgramParser()
+	var repeated Statgram
+	for len(repeated) < len(statgram) {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		repeated = append(repeated, parser.ParseStream(line)...)
+	}
+	if s, ok := assertDeepEqual(statgram, repeated); !ok {
+		t.Error(s)
+	}
+}
+
+func TestRepeatOnly(t *testing.T) {
+	conn := listenRepeaterUDP(t)
+	defer conn.Close()
+	repeater, err := NewRepeater(conn.LocalAddr().String(), RepeatOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repeater.Close()
+	notifier := make(chan Statgram)
+	input := make(CoordinatedReader)
+	control := runReceiver("test", &input, nil, repeater, nil, notifier)
+	input.Write([]byte("x:1|c"))
+	<-notifier
+	control <- nil
+	snapshot := <-control
+	if _, ok := snapshot.counts["x"]; ok {
+		t.Error("expected x not to be aggregated")
+	}
+	repeater.Flush(nil)
+	if datagram := receiveDatagram(t, conn); string(datagram) != "x:1|c\n" {
+		t.Errorf("unexpected datagram %#v", string(datagram))
+	}
+}
+
+func TestRepeaterInvalidAddress(t *testing.T) {
+	if _, err := NewRepeater("http://localhost:8125"); err == nil {
+		t.Error("expected an error for an http address")
+	}
+}
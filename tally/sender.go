@@ -0,0 +1,231 @@
+package tally
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SENDER_QUEUE_SIZE is the most batches a backend's sender holds awaiting
+// delivery, beyond which new ones are dropped.
+const SENDER_QUEUE_SIZE = 100
+
+// batchSender delivers a backend's rendered batches from a bounded queue in a
+// goroutine of its own, so that flushes don't wait for delivery. Batches that
+// fail are retried with exponential backoff, up to a limit.
+type batchSender struct {
+	name    string // of the backend, for logging
+	send    func(batch []byte) (retry bool, err error)
+	retries int
+	backoff time.Duration // before the first retry, doubling for each
+
+	batches  chan []byte
+	stopping chan struct{} // closed by close
+	stopped  chan struct{} // closed when run has finished
+	stopOnce sync.Once
+
+	mu        sync.Mutex
+	sent      int64 // batches delivered
+	dropped   int64 // batches that couldn't be delivered
+	lastError error
+}
+
+// newBatchSender creates a sender that makes attempts to deliver each batch
+// by calling send, which returns whether a failed attempt is worth retrying.
+// It must be started by calling run in a goroutine.
+func newBatchSender(name string, retries int,
+	send func(batch []byte) (retry bool, err error)) *batchSender {
+	return &batchSender{
+		name:     name,
+		send:     send,
+		retries:  retries,
+		backoff:  RETRY_MIN_BACKOFF,
+		batches:  make(chan []byte, SENDER_QUEUE_SIZE),
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// queue adds batches to the queue, returning an error if any are dropped
+// because it's full. Backends call this from Flush.
+func (sender *batchSender) queue(batches [][]byte) error {
+	dropped := 0
+	for _, batch := range batches {
+		select {
+		case sender.batches <- batch:
+		default:
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		sender.mu.Lock()
+		sender.dropped += int64(dropped)
+		sender.mu.Unlock()
+		return errors.New(fmt.Sprintf(
+			"%s queue full, dropped %d batches", sender.name, dropped))
+	}
+	return nil
+}
+
+// run delivers queued batches until the sender is closed, then makes one
+// attempt to deliver each batch that's left.
+func (sender *batchSender) run() {
+	defer close(sender.stopped)
+	for {
+		select {
+		case batch := <-sender.batches:
+			sender.deliver(batch)
+		case <-sender.stopping:
+			for {
+				select {
+				case batch := <-sender.batches:
+					sender.deliver(batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver sends a batch, retrying with exponential backoff if that's worth
+// doing, unless the sender is closing.
+func (sender *batchSender) deliver(batch []byte) {
+	backoff := sender.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := sender.send(batch)
+		if err == nil {
+			sender.mu.Lock()
+			sender.sent++
+			sender.mu.Unlock()
+			return
+		}
+		closing := false
+		select {
+		case <-sender.stopping:
+			closing = true
+		default:
+		}
+		if !retry || attempt >= sender.retries || closing {
+			errorlog("dropped %s batch: %s", sender.name, err)
+			sender.mu.Lock()
+			sender.dropped++
+			sender.lastError = err
+			sender.mu.Unlock()
+			return
+		}
+		errorlog("failed to write to %s, retrying in %s: %s",
+			sender.name, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-sender.stopping:
+		}
+		if backoff *= 2; backoff > RETRY_MAX_BACKOFF {
+			backoff = RETRY_MAX_BACKOFF
+		}
+	}
+}
+
+// status summarizes the sender's deliveries, for a backend's Status.
+func (sender *batchSender) status() string {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	status := fmt.Sprintf("%d batches sent, %d pending, %d dropped",
+		sender.sent, len(sender.batches), sender.dropped)
+	if sender.lastError != nil {
+		status += fmt.Sprintf("; last error: %s", sender.lastError)
+	}
+	return status
+}
+
+// close stops retrying failed batches, and returns once each batch still
+// queued has been sent or has failed. Backends call this from Close before
+// closing their connections.
+func (sender *batchSender) close() {
+	sender.stopOnce.Do(func() {
+		close(sender.stopping)
+	})
+	<-sender.stopped
+}
+
+// postBatch makes an HTTP POST request with a batch as its body, compressed
+// if gzipped is set, returning whether it's worth retrying if it fails. Client
+// errors other than 429 mean the batch would be rejected again.
+func postBatch(client *http.Client, url, contentType string, batch []byte,
+	gzipped bool) (retry bool, err error) {
+	var body io.Reader = bytes.NewReader(batch)
+	if gzipped {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(batch)
+		writer.Close()
+		body = &compressed
+	}
+	request, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if gzipped {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, response.Body)
+		return false, nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+	err = errors.New(fmt.Sprintf("%s responded %s: %s", request.URL.Host,
+		response.Status, strings.TrimSpace(string(message))))
+	retry = response.StatusCode >= 500 ||
+		response.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// streamWriter writes batches to a TCP connection that's kept open between
+// them, and reopened after an error.
+type streamWriter struct {
+	address string
+	timeout time.Duration // for connecting, and for each write
+	conn    net.Conn
+}
+
+// write makes one attempt to write a batch. It's not safe for concurrent use.
+func (writer *streamWriter) write(batch []byte) (err error) {
+	if writer.conn != nil && isClosed(writer.conn) {
+		writer.conn.Close()
+		writer.conn = nil
+	}
+	if writer.conn == nil {
+		writer.conn, err = net.DialTimeout("tcp", writer.address,
+			writer.timeout)
+		if err != nil {
+			return
+		}
+	}
+	writer.conn.SetWriteDeadline(time.Now().Add(writer.timeout))
+	if _, err = writer.conn.Write(batch); err != nil {
+		writer.conn.Close()
+		writer.conn = nil
+	}
+	return
+}
+
+func (writer *streamWriter) close() error {
+	if writer.conn != nil {
+		return writer.conn.Close()
+	}
+	return nil
+}
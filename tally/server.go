@@ -3,81 +3,297 @@ package tally
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"runtime"
+	"sync"
 	"time"
 )
 
+// DEFAULT_SHUTDOWN_TIMEOUT is how long a server may spend sending its final
+// report when stopped, by default. It's less than the 5 seconds upstart allows
+// before killing a stopped process.
+const DEFAULT_SHUTDOWN_TIMEOUT = 4 * time.Second
+
+// TCPListener is a server option enabling a TCP listener for newline-delimited
+// statgrams on the given port.
+type TCPListener struct {
+	Port int
+}
+
+// ShutdownTimeout is a server option bounding the time the server may spend
+// sending its final report when stopped.
+type ShutdownTimeout time.Duration
+
 type Server struct {
-	receiverHost  string
-	receiverPort  int
-	numWorkers    int
-	flushInterval time.Duration
-	graphite      *Graphite
-	harold        *Harold
-	conn          *net.UDPConn
-	snapshot      *Snapshot
-	lastReport    time.Time
+	receiverHost     string
+	receiverPort     int
+	numWorkers       int
+	flushInterval    time.Duration
+	queue            *ReportQueue // for delivering reports to graphite
+	backends         *BackendRegistry
+	repeater         *Repeater // nil if not configured
+	harold           *Harold
+	timerPercentiles TimerPercentiles
+	tagFormat        TagFormat
+	tcpPort          int
+	unixSockets      UnixSockets
+	reusePort        bool
+	receiveBuffer    int
+	shutdownTimeout  time.Duration
+	conns            []*net.UDPConn
+	unixConn         *net.UnixConn
+	forwarders       sync.WaitGroup // for goroutines reading unixConn
+	unixCounts       datagramCounts // of datagrams read from unixConn
+	socketInodes     []uint64       // for finding each conn's drops in /proc
+	streams          chan Statgram
+	streamServers    []*StreamServer
+	snapshot         *Snapshot
+	lastReport       time.Time
+	stopping         chan struct{} // closed when the server is stopped
+	stopOnce         sync.Once
+	reloads          chan serverSettings
+	ticker           *time.Ticker       // for flushes
+	heartbeats       chan time.Duration // for harold, nil if not configured
+	reloadStatus     ReloadStatus
+	statusLock       sync.Mutex // for reloadStatus, read by the status page
 }
 
 func NewServer(host string, port int, numWorkers int,
-	flushInterval time.Duration, graphite *Graphite, harold *Harold) *Server {
-	return &Server{
-		receiverHost:  host,
-		receiverPort:  port,
-		numWorkers:    numWorkers,
-		flushInterval: flushInterval,
-		graphite:      graphite,
-		harold:        harold,
+	flushInterval time.Duration, graphite *Graphite, harold *Harold,
+	options ...interface{}) (server *Server, err error) {
+	server = &Server{
+		receiverHost:     host,
+		receiverPort:     port,
+		numWorkers:       numWorkers,
+		flushInterval:    flushInterval,
+		harold:           harold,
+		timerPercentiles: DefaultTimerPercentiles,
+		shutdownTimeout:  DEFAULT_SHUTDOWN_TIMEOUT,
+		stopping:         make(chan struct{}),
+		reloads:          make(chan serverSettings),
+		backends:         NewBackendRegistry(),
+	}
+	queueSize := DEFAULT_REPORT_QUEUE_SIZE
+	var spoolOption ReportSpool
+	var backends []Backend
+	for _, option := range options {
+		switch option.(type) {
+		case TimerPercentiles:
+			server.timerPercentiles = option.(TimerPercentiles)
+		case TagFormat:
+			server.tagFormat = option.(TagFormat)
+		case TCPListener:
+			server.tcpPort = option.(TCPListener).Port
+		case UnixSockets:
+			server.unixSockets = option.(UnixSockets)
+		case ReusePort:
+			server.reusePort = bool(option.(ReusePort))
+		case ReceiveBuffer:
+			server.receiveBuffer = int(option.(ReceiveBuffer))
+		case ShutdownTimeout:
+			server.shutdownTimeout = time.Duration(option.(ShutdownTimeout))
+		case ReportQueueSize:
+			queueSize = int(option.(ReportQueueSize))
+		case ReportSpool:
+			spoolOption = option.(ReportSpool)
+		case *Repeater:
+			server.repeater = option.(*Repeater)
+			backends = append(backends, server.repeater)
+		case Backend:
+			backends = append(backends, option.(Backend))
+		default:
+			err = errors.New(fmt.Sprintf("invalid server option %T", option))
+			return
+		}
+	}
+	server.queue = NewReportQueue(graphite, queueSize)
+	if spoolOption.Dir != "" {
+		if err = server.queue.SetSpool(spoolOption); err != nil {
+			return
+		}
+	}
+	for _, backend := range append([]Backend{server.queue}, backends...) {
+		if err = server.backends.Register(backend); err != nil {
+			return
+		}
 	}
+	return
 }
 
 func (server *Server) setup() error {
 	runtime.GOMAXPROCS(server.numWorkers + 1)
-	receiver_addr, err := net.ResolveUDPAddr("udp",
-		fmt.Sprintf("%s:%d", server.receiverHost, server.receiverPort))
-	if err != nil {
+	if err := server.listenUDP(); err != nil {
 		return err
 	}
-	server.conn, err = net.ListenUDP("udp", receiver_addr)
-	return err
+	server.streams = make(chan Statgram)
+	if server.tcpPort != 0 {
+		listener, err := net.Listen("tcp",
+			fmt.Sprintf("%s:%d", server.receiverHost, server.tcpPort))
+		if err != nil {
+			return err
+		}
+		server.startStreamServer("tcp", listener)
+	}
+	if server.unixSockets.DatagramPath != "" {
+		conn, err := server.unixSockets.listenDatagram()
+		if err != nil {
+			return err
+		}
+		server.unixConn = conn
+		server.forwarders.Add(server.numWorkers)
+		for i := 0; i < server.numWorkers; i++ {
+			go func() {
+				defer server.forwarders.Done()
+				err := forwardDatagrams(conn, server.streams,
+					&server.unixCounts)
+				if !errors.Is(err, net.ErrClosed) {
+					errorlog("unix datagram listener terminated: %s", err)
+				}
+			}()
+		}
+	}
+	if server.unixSockets.StreamPath != "" {
+		listener, err := server.unixSockets.listenStream()
+		if err != nil {
+			return err
+		}
+		server.startStreamServer("unix", listener)
+	}
+	return nil
+}
+
+// listenUDP opens the UDP socket, or one per worker if reusePort is set.
+func (server *Server) listenUDP() error {
+	address := fmt.Sprintf("%s:%d", server.receiverHost, server.receiverPort)
+	if server.reusePort {
+		for i := 0; i < server.numWorkers; i++ {
+			conn, err := listenUDPReusePort(address)
+			if err != nil {
+				return err
+			}
+			server.conns = append(server.conns, conn)
+		}
+	} else {
+		receiver_addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenUDP("udp", receiver_addr)
+		if err != nil {
+			return err
+		}
+		server.conns = append(server.conns, conn)
+	}
+	if server.receiveBuffer > 0 {
+		for _, conn := range server.conns {
+			if err := server.setReceiveBuffer(conn); err != nil {
+				return err
+			}
+		}
+	}
+	for _, conn := range server.conns {
+		inode, err := socketInode(conn)
+		if err != nil {
+			infolog("socket drops won't be reported: %s", err)
+			server.socketInodes = nil
+			break
+		}
+		server.socketInodes = append(server.socketInodes, inode)
+	}
+	return nil
+}
+
+func (server *Server) setReceiveBuffer(conn *net.UDPConn) error {
+	if err := conn.SetReadBuffer(server.receiveBuffer); err != nil {
+		return err
+	}
+	if size, err := readBufferSize(conn); err == nil &&
+		size < server.receiveBuffer {
+		infolog("udp receive buffer limited to %d bytes by the kernel", size)
+	}
+	return nil
+}
+
+func (server *Server) readers() []io.Reader {
+	readers := make([]io.Reader, len(server.conns))
+	for i, conn := range server.conns {
+		readers[i] = conn
+	}
+	return readers
+}
+
+func (server *Server) startStreamServer(name string, listener net.Listener) {
+	ss := NewStreamServer(name, listener, server.streams)
+	server.streamServers = append(server.streamServers, ss)
+	go func() {
+		err := ss.Serve()
+		if !errors.Is(err, net.ErrClosed) {
+			errorlog("%s listener terminated: %s", name, err)
+		}
+	}()
+}
+
+// closeInputs closes every source of statgrams, returning once the statgrams
+// already read from them have been passed on to the receivers.
+func (server *Server) closeInputs() {
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	if server.unixConn != nil {
+		server.unixConn.Close()
+	}
+	for _, ss := range server.streamServers {
+		ss.Close()
+	}
+	server.forwarders.Wait()
+	close(server.streams)
+}
+
+// Stop makes Loop send a final report and return. It may be called any number
+// of times, from any goroutine.
+func (server *Server) Stop() {
+	server.stopOnce.Do(func() {
+		close(server.stopping)
+	})
 }
 
 func (server *Server) Loop() error {
-	var intervals chan time.Duration
 	if err := server.setup(); err != nil {
 		return err
 	}
 	if server.harold != nil {
-		intervals = server.harold.HeartMonitor("tallier")
+		server.heartbeats = server.harold.HeartMonitor("tallier")
 	}
-	snapchan := Aggregate(server.conn, server.numWorkers)
+	snapchan, drained := Aggregate(server.readers(), server.streams,
+		server.repeater, server.numWorkers)
+	go server.queue.Run()
 	ServeStatus(server)
 	infolog("running")
 	server.snapshot = NewSnapshot()
 	server.snapshot.stringCountIntervals = []time.Duration{
 		time.Minute, time.Hour}
+	server.snapshot.timerPercentiles = server.timerPercentiles
+	server.snapshot.tagFormat = server.tagFormat
 	server.snapshot.start = time.Now()
-	tick := time.Tick(server.flushInterval)
+	server.ticker = time.NewTicker(server.flushInterval)
 	for {
-		<-tick
+		select {
+		case <-server.ticker.C:
+		case settings := <-server.reloads:
+			server.applySettings(settings)
+			continue
+		case <-server.stopping:
+			return server.shutdown(snapchan, drained)
+		}
 		snapchan <- server.snapshot
 		snapshot := <-snapchan
 		nextStart := time.Now()
 		server.addInternalStats(snapshot)
 		server.lastReport = nextStart
-		for {
-			infolog("sending snapshot with %d stats to graphite",
-				snapshot.NumStats())
-			var err error
-			if err = server.graphite.SendReport(snapshot); err == nil {
-				break
-			}
-			errorlog("failed to send graphite report: %s", err)
-			time.Sleep(time.Second)
-		}
-		if server.harold != nil {
-			intervals <- 3 * server.flushInterval
+		server.backends.Flush(snapshot)
+		if server.heartbeats != nil {
+			server.heartbeats <- 3 * server.flushInterval
 		}
 		snapshot.Flush()
 		snapshot.start = nextStart
@@ -85,6 +301,49 @@ func (server *Server) Loop() error {
 	return errors.New("server loop terminated")
 }
 
+// shutdown stops reading statgrams, then sends a final report of everything
+// received since the last one, followed by a final heartbeat to harold. It
+// gives up if this takes longer than the shutdown timeout, leaving any reports
+// not yet delivered in the spool, if there is one.
+func (server *Server) shutdown(snapchan chan *Snapshot,
+	drained chan struct{}) error {
+	infolog("shutting down")
+	done := make(chan struct{})
+	go func() {
+		server.closeInputs()
+		<-drained
+		snapchan <- server.snapshot
+		snapshot := <-snapchan
+		server.addInternalStats(snapshot)
+		server.backends.Flush(snapshot)
+		server.queue.Drain(nil)
+		server.backends.Close()
+		if server.harold != nil {
+			r, err := server.harold.Heartbeat("tallier",
+				3*server.flushInterval)
+			if err != nil {
+				errorlog("harold heartbeat failed: %#v", err)
+			} else if r != nil {
+				r.Body.Close()
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		infolog("shutdown complete")
+		return nil
+	case <-time.After(server.shutdownTimeout):
+		if server.queue.spooling() {
+			// nothing is lost, it'll be delivered after a restart
+			server.queue.SpoolAll()
+			return nil
+		}
+		return errors.New(fmt.Sprintf(
+			"final report not sent within %s", server.shutdownTimeout))
+	}
+}
+
 func (server *Server) addInternalStats(snapshot *Snapshot) {
 	var ms runtime.MemStats
 	runtime.ReadMemStats(&ms)
@@ -125,7 +384,51 @@ func (server *Server) addInternalStats(snapshot *Snapshot) {
 		}
 	}
 
+	// these are running totals, as kept by the kernel
+	if server.socketInodes != nil {
+		if drops, err := udpDrops(); err == nil {
+			var total int64
+			for i, inode := range server.socketInodes {
+				snapshot.Report(fmt.Sprintf("tallier.udp.drops.socket_%d", i),
+					float64(drops[inode]))
+				total += drops[inode]
+			}
+			snapshot.Report("tallier.udp.drops", float64(total))
+		}
+	}
+	if count, err := udpRcvbufErrors(); err == nil {
+		snapshot.Report("tallier.udp.rcvbuf_errors", float64(count))
+	}
+
+	if server.unixConn != nil {
+		// unix datagrams are counted like those read by the receivers
+		messages, bytes := server.unixCounts.take()
+		snapshot.Count("tallier.messages.child_unix", float64(messages))
+		snapshot.Count("tallier.messages.total", float64(messages))
+		snapshot.Count("tallier.bytes.child_unix", float64(bytes))
+		snapshot.Count("tallier.bytes.total", float64(bytes))
+	}
+
+	for _, ss := range server.streamServers {
+		snapshot.Report("tallier."+ss.name+".connections",
+			float64(ss.Connections()))
+	}
+
+	retries, dropped := server.queue.TakeStats()
+	snapshot.Report("tallier.graphite.queue_depth",
+		float64(server.queue.Len()))
+	snapshot.Count("tallier.graphite.retries", float64(retries))
+	snapshot.Count("tallier.graphite.dropped_reports", float64(dropped))
+	if server.queue.spooling() {
+		spooled, size := server.queue.SpoolStats()
+		snapshot.Report("tallier.graphite.spool.reports", float64(spooled))
+		snapshot.Report("tallier.graphite.spool.bytes", float64(size))
+	}
+
+	server.backends.AddInternalStats(snapshot)
+
 	snapshot.Report("tallier.num_workers", float64(snapshot.numChildren))
-	tot := len(snapshot.counts) + len(snapshot.timings) + len(snapshot.reports) + 1
+	tot := len(snapshot.counts) + len(snapshot.timings) + len(snapshot.gauges) +
+		len(snapshot.sets) + len(snapshot.reports) + 1
 	snapshot.Report("tallier.num_stats", float64(tot))
 }
@@ -1,27 +1,94 @@
 package tally
 
 import (
+	"errors"
 	"fmt"
 	"math"
-	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-const TIMINGS_INITIAL_CAPACITY = 1024
 const STRING_COUNT_CAPACITY = 1024
 
+// TimerPercentiles lists the percentiles (between 0 and 100) for which upper,
+// mean, sum, and count statistics are reported for each timer. It implements
+// flag.Value, accepting a comma-separated list such as "50,90,99.9".
+type TimerPercentiles []float64
+
+var DefaultTimerPercentiles = TimerPercentiles{90, 99}
+
+func (percentiles *TimerPercentiles) String() string {
+	strs := make([]string, len(*percentiles))
+	for i, p := range *percentiles {
+		strs[i] = strconv.FormatFloat(p, 'f', -1, 64)
+	}
+	return strings.Join(strs, ",")
+}
+
+func (percentiles *TimerPercentiles) Set(value string) error {
+	parsed := TimerPercentiles{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid percentile %#v", field))
+		}
+		if !(p > 0 && p <= 100) {
+			return errors.New(fmt.Sprintf(
+				"percentile %v must be greater than 0 and at most 100", p))
+		}
+		parsed = append(parsed, p)
+	}
+	*percentiles = parsed
+	return nil
+}
+
+// percentileSuffix returns the name given to a percentile in stat paths, e.g.
+// "99_9".
+func percentileSuffix(p float64) string {
+	return strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
+
 type ReportedValue struct {
 	value     float64
 	timestamp time.Time
 }
 
+// GaugeValue is the state of a gauge. Within a receiver's snapshot a gauge may
+// have only seen relative adjustments, in which case absolute is false and the
+// value is applied as a delta when aggregated.
+//
+// Absolute values are stamped with a sequence number shared by all receivers,
+// so that when receivers' snapshots are aggregated the most recent absolute
+// value wins regardless of the order the snapshots arrive in. The relative
+// adjustments aggregated during the interval are kept in pending, so that they
+// can be applied on top of whichever absolute value wins.
+type GaugeValue struct {
+	value    float64
+	absolute bool
+	sequence uint64
+	pending  float64
+}
+
+// gaugeSequence numbers absolute gauge values across all receivers.
+var gaugeSequence uint64
+
 type Snapshot struct {
 	reports              map[string]ReportedValue
 	counts               map[string]float64
-	timings              map[string][]float64
+	gauges               map[string]GaugeValue
+	sets                 map[string]*HyperLogLog
+	timings              map[string]*TimerSketch
+	histograms           map[string]*TimerHistogram // of the timers with one
 	stringCounts         map[string]*FrequencyCounter
 	stringCountIntervals []time.Duration
+	timerPercentiles     TimerPercentiles
+	tagFormat            TagFormat
 	start                time.Time
 	duration             time.Duration
 	numChildren          int
@@ -31,27 +98,92 @@ func NewSnapshot() *Snapshot {
 	return &Snapshot{
 		reports:      make(map[string]ReportedValue),
 		counts:       make(map[string]float64),
-		timings:      make(map[string][]float64),
+		gauges:       make(map[string]GaugeValue),
+		sets:         make(map[string]*HyperLogLog),
+		timings:      make(map[string]*TimerSketch),
+		histograms:   make(map[string]*TimerHistogram),
 		stringCounts: make(map[string]*FrequencyCounter),
 		numChildren:  0,
 	}
 }
 
 func (snapshot *Snapshot) NumStats() int {
-	return len(snapshot.counts) + len(snapshot.timings)
+	return len(snapshot.counts) + len(snapshot.timings) +
+		len(snapshot.gauges) + len(snapshot.sets)
 }
 
 func (snapshot *Snapshot) Count(key string, value float64) {
 	snapshot.counts[key] += value
 }
 
-func (snapshot *Snapshot) Time(key string, value float64) {
-	var timings []float64
-	var present bool
-	if timings, present = snapshot.timings[key]; !present {
-		timings = make([]float64, 0, TIMINGS_INITIAL_CAPACITY)
+// Gauge sets the value of a gauge, replacing any previous value.
+func (snapshot *Snapshot) Gauge(key string, value float64) {
+	snapshot.gauges[key] = GaugeValue{
+		value:    value,
+		absolute: true,
+		sequence: atomic.AddUint64(&gaugeSequence, 1),
+	}
+}
+
+// AdjustGauge adds delta to the current value of a gauge.
+func (snapshot *Snapshot) AdjustGauge(key string, delta float64) {
+	gauge := snapshot.gauges[key]
+	gauge.value += delta
+	snapshot.gauges[key] = gauge
+}
+
+// AddToSet records a member of a set, whose number of distinct members is
+// estimated each interval.
+func (snapshot *Snapshot) AddToSet(key, member string) {
+	hll, ok := snapshot.sets[key]
+	if !ok {
+		hll = NewHyperLogLog()
+		snapshot.sets[key] = hll
+	}
+	hll.Add(member)
+}
+
+func (snapshot *Snapshot) timer(key string) *TimerSketch {
+	sketch, ok := snapshot.timings[key]
+	if !ok {
+		sketch = NewTimerSketch()
+		snapshot.timings[key] = sketch
+	}
+	return sketch
+}
+
+// histogram returns the histogram for a timer key, or nil if no histogram is
+// configured for it. Only keys with a histogram are remembered, until the
+// snapshot is flushed, so the patterns are matched against the other keys
+// each time they're timed.
+func (snapshot *Snapshot) histogram(key string) *TimerHistogram {
+	histogram, ok := snapshot.histograms[key]
+	if !ok {
+		name, _ := splitStatKey(key)
+		if bounds := timerHistograms.boundsFor(name); bounds != nil {
+			histogram = NewTimerHistogram(bounds)
+			snapshot.histograms[key] = histogram
+		}
+	}
+	return histogram
+}
+
+// Time records a timing. An optional sample rate may be given, in which case
+// the timing is counted as 1/sampleRate occurrences for the count and rate
+// statistics. Timings that aren't finite are ignored.
+func (snapshot *Snapshot) Time(key string, value float64,
+	sampleRate ...float64) {
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return
+	}
+	rate := 1.0
+	if len(sampleRate) > 0 {
+		rate = sampleRate[0]
+	}
+	snapshot.timer(key).AddSampled(value, rate)
+	if histogram := snapshot.histogram(key); histogram != nil {
+		histogram.Add(value, rate)
 	}
-	snapshot.timings[key] = append(timings, value)
 }
 
 func (snapshot *Snapshot) CountString(key, value string, count float64) {
@@ -75,16 +207,27 @@ func (snapshot *Snapshot) Report(key string, value float64, ts ...time.Time) {
 }
 
 // ProcessStatgram accumulates a statistic report into the current snapshot.
+// Tagged samples are kept apart from samples of the same name with different
+// tags, except for string counts, which ignore tags.
 func (snapshot *Snapshot) ProcessStatgram(statgram Statgram) {
 	for _, sample := range statgram {
+		key := tagKey(sample.key, sample.tags)
 		switch sample.valueType {
 		case COUNTER:
-			snapshot.Count(sample.key, sample.value/sample.sampleRate)
+			snapshot.Count(key, sample.value/sample.sampleRate)
 		case TIMER:
-			snapshot.Time(sample.key, sample.value)
+			snapshot.Time(key, sample.value, sample.sampleRate)
 		case STRING:
 			snapshot.CountString(sample.key, sample.stringValue,
 				sample.value/sample.sampleRate)
+		case GAUGE:
+			if sample.delta {
+				snapshot.AdjustGauge(key, sample.value)
+			} else {
+				snapshot.Gauge(key, sample.value)
+			}
+		case SET:
+			snapshot.AddToSet(key, sample.stringValue)
 		}
 		snapshot.CountString("tallier.samples", sample.key, 1)
 	}
@@ -99,8 +242,36 @@ func (snapshot *Snapshot) Aggregate(child *Snapshot) {
 			snapshot.Count("tallier.bytes.total", value)
 		}
 	}
-	for key, timings := range child.timings {
-		snapshot.timings[key] = append(snapshot.timings[key], timings...)
+	for key, sketch := range child.timings {
+		snapshot.timer(key).Merge(sketch)
+	}
+	for key, histogram := range child.histograms {
+		if h := snapshot.histogram(key); h != nil {
+			h.Merge(histogram)
+		}
+	}
+	for key, gauge := range child.gauges {
+		current := snapshot.gauges[key]
+		if !gauge.absolute {
+			current.value += gauge.value
+			current.pending += gauge.value
+		} else if !current.absolute || gauge.sequence > current.sequence {
+			// A receiver's adjustments made after its newest absolute value
+			// are already included in gauge.value. Adjustments a receiver made
+			// before an absolute value that is later superseded are lost.
+			current.value = gauge.value + current.pending
+			current.absolute = true
+			current.sequence = gauge.sequence
+		}
+		snapshot.gauges[key] = current
+	}
+	for key, set := range child.sets {
+		hll, ok := snapshot.sets[key]
+		if !ok {
+			hll = NewHyperLogLog()
+			snapshot.sets[key] = hll
+		}
+		hll.Merge(set)
 	}
 	for key, stringCounts := range child.stringCounts {
 		fc, ok := snapshot.stringCounts[key]
@@ -114,47 +285,97 @@ func (snapshot *Snapshot) Aggregate(child *Snapshot) {
 	snapshot.numChildren++
 }
 
-func (snapshot *Snapshot) GraphiteReport() (report []string) {
-	timestamp := fmt.Sprintf(" %d\n", snapshot.start.Unix())
-	makeLine := func(format string, params ...interface{}) string {
-		return fmt.Sprintf(format, params...) + timestamp
+func (snapshot *Snapshot) Start() time.Time {
+	return snapshot.start
+}
+
+func (snapshot *Snapshot) Duration() time.Duration {
+	return snapshot.duration
+}
+
+func (snapshot *Snapshot) TimerPercentiles() TimerPercentiles {
+	if snapshot.timerPercentiles == nil {
+		return DefaultTimerPercentiles
 	}
-	report = make([]string, 0, 2*len(snapshot.counts)+6*
-		len(snapshot.timings)+len(snapshot.reports)+2)
-	counterScale := 1.0 / snapshot.duration.Seconds()
+	return snapshot.timerPercentiles
+}
+
+func (snapshot *Snapshot) EachCount(f func(key string, value float64)) {
 	for key, value := range snapshot.counts {
-		report = append(report, makeLine("stats.%s %f", key, value*counterScale))
-		report = append(report, makeLine("stats_counts.%s %f", key, value))
+		f(key, value)
 	}
-	for key, timings := range snapshot.timings {
-		if len(timings) == 0 {
+}
+
+func (snapshot *Snapshot) EachGauge(f func(key string, value float64)) {
+	for key, gauge := range snapshot.gauges {
+		f(key, gauge.value)
+	}
+}
+
+func (snapshot *Snapshot) EachSet(f func(key string, count float64)) {
+	for key, set := range snapshot.sets {
+		f(key, set.Count())
+	}
+}
+
+func (snapshot *Snapshot) EachTimer(f func(key string, timer TimerView)) {
+	for key, sketch := range snapshot.timings {
+		if sketch.Count() == 0 {
 			continue
 		}
-		sum := 0.0
-		for _, value := range timings {
-			sum += value
-		}
-		sort.Float64s(timings)
-		report = append(report, makeLine("stats.timers.%s.lower %f", key,
-			timings[0]))
-		report = append(report, makeLine("stats.timers.%s.upper %f", key,
-			timings[len(timings)-1]))
-		report = append(report, makeLine("stats.timers.%s.upper_90 %f", key,
-			timings[int(math.Ceil(0.9*float64(len(timings)))-1)]))
-		report = append(report, makeLine("stats.timers.%s.upper_99 %f", key,
-			timings[int(math.Ceil(0.99*float64(len(timings)))-1)]))
-		report = append(report, makeLine("stats.timers.%s.mean %f", key,
-			sum/float64(len(timings))))
-		report = append(report, makeLine("stats.timers.%s.rate %f", key,
-			float64(len(timings))/snapshot.duration.Seconds()))
+		f(key, timerView{sketch, snapshot.histograms[key]})
 	}
+}
+
+func (snapshot *Snapshot) EachReport(
+	f func(key string, value float64, timestamp time.Time)) {
 	for key, rvalue := range snapshot.reports {
-		report = append(report, fmt.Sprintf("stats.%s %f %d\n", key,
-			rvalue.value, rvalue.timestamp.Unix()))
+		f(key, rvalue.value, rvalue.timestamp)
+	}
+}
+
+// EachStringCount calls f for each value of each string counted during the
+// snapshot's interval, with its count.
+func (snapshot *Snapshot) EachStringCount(
+	f func(key, value string, count float64)) {
+	for key, fc := range snapshot.stringCounts {
+		for value, mc := range fc.frequencies {
+			// the first level counts since the last flush
+			if count := (*mc)[0].Current; count > 0 {
+				f(key, value, count)
+			}
+		}
 	}
-	return
 }
 
+// timerView presents a timer's sketch and histogram as a TimerView.
+type timerView struct {
+	*TimerSketch
+	histogram *TimerHistogram // nil if not configured
+}
+
+func (timer timerView) Histogram() (bounds, cumulative []float64) {
+	if timer.histogram == nil {
+		return nil, nil
+	}
+	return timer.histogram.bounds, timer.histogram.Cumulative()
+}
+
+// StatPath renders the graphite path for a stat, placing the key's tags (if
+// any) according to the snapshot's tag format.
+func (snapshot *Snapshot) StatPath(prefix, key, suffix string) string {
+	name, tags := splitStatKey(key)
+	if tags == "" {
+		return prefix + key + suffix
+	}
+	if snapshot.tagFormat == TAGS_AS_PATH {
+		return prefix + name + "." + tagsAsPath(tags) + suffix
+	}
+	return prefix + name + suffix + ";" + tags
+}
+
+// Flush clears the snapshot for the next interval. Gauges are retained, so that
+// they continue to be reported until they're next updated.
 func (snapshot *Snapshot) Flush() {
 	for k, _ := range snapshot.reports {
 		delete(snapshot.reports, k)
@@ -162,8 +383,18 @@ func (snapshot *Snapshot) Flush() {
 	for k, _ := range snapshot.counts {
 		delete(snapshot.counts, k)
 	}
-	for k, ts := range snapshot.timings {
-		snapshot.timings[k] = ts[:0]
+	for _, sketch := range snapshot.timings {
+		sketch.Reset()
+	}
+	for k, _ := range snapshot.histograms {
+		delete(snapshot.histograms, k)
+	}
+	for k, _ := range snapshot.sets {
+		delete(snapshot.sets, k)
+	}
+	for key, gauge := range snapshot.gauges {
+		gauge.pending = 0
+		snapshot.gauges[key] = gauge
 	}
 	for _, fcs := range snapshot.stringCounts {
 		fcs.Trim()
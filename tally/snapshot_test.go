@@ -2,8 +2,9 @@ package tally
 
 import (
 	"fmt"
+	"math"
 	"runtime"
-	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,8 +14,8 @@ func TestSnapshots(t *testing.T) {
 	a := NewSnapshot()
 	b := NewSnapshot()
 	a.ProcessStatgram(Statgram{
-		Sample{"x", 1.0, COUNTER, 1.0, ""},
-		Sample{"y", 1.0, COUNTER, 0.5, ""},
+		Sample{key: "x", value: 1.0, valueType: COUNTER, sampleRate: 1.0},
+		Sample{key: "y", value: 1.0, valueType: COUNTER, sampleRate: 0.5},
 	})
 	for i := 0.0; i < 10; i++ {
 		a.Time("z", i)
@@ -22,8 +23,8 @@ func TestSnapshots(t *testing.T) {
 	a.Count("tallier.messages.child_1", 2)
 	a.Count("tallier.bytes.child_1", 20)
 	b.ProcessStatgram(Statgram{
-		Sample{"y", 3.0, COUNTER, 1.0, ""},
-		Sample{"z", 4.0, COUNTER, 1.0, ""},
+		Sample{key: "y", value: 3.0, valueType: COUNTER, sampleRate: 1.0},
+		Sample{key: "z", value: 4.0, valueType: COUNTER, sampleRate: 1.0},
 	})
 	for i := 0.0; i < 5; i++ {
 		b.Time("z", 2*i)
@@ -53,7 +54,6 @@ func TestSnapshots(t *testing.T) {
 	expected.numChildren = 2
 	parent.Aggregate(a)
 	parent.Aggregate(b)
-	sort.Float64s(parent.timings["z"])
 	if s, ok := assertDeepEqual(expected, parent); !ok {
 		t.Error(s)
 	}
@@ -67,7 +67,7 @@ func TestGraphiteReport(t *testing.T) {
 	snapshot := NewSnapshot()
 	snapshot.start = now
 	snapshot.duration = time.Duration(10) * time.Second
-	report := snapshot.GraphiteReport()
+	report := GraphiteReport(snapshot)
 	if s, ok := assertDeepEqual(expected, report); !ok {
 		t.Error(s)
 	}
@@ -81,9 +81,22 @@ func TestGraphiteReport(t *testing.T) {
 		format("stats.timers.y.lower", 1),
 		format("stats.timers.y.upper", 10),
 		format("stats.timers.y.upper_90", 9),
-		format("stats.timers.y.upper_99", 10),
+		format("stats.timers.y.mean_90", 5),
+		format("stats.timers.y.sum_90", 45),
+		format("stats.timers.y.count_90", 9),
+		format("stats.timers.y.upper_99_9", 10),
+		format("stats.timers.y.mean_99_9", 5.5),
+		format("stats.timers.y.sum_99_9", 55),
+		format("stats.timers.y.count_99_9", 10),
 		format("stats.timers.y.mean", 5.5),
+		format("stats.timers.y.median", 5),
+		format("stats.timers.y.sum", 55),
+		format("stats.timers.y.count", 10),
+		format("stats.timers.y.count_ps", 1),
+		format("stats.timers.y.std", math.Sqrt(8.25)),
 		format("stats.timers.y.rate", 1),
+		format("stats.gauges.z", 3),
+		format("stats.sets.w.count", 1),
 	}
 
 	child := NewSnapshot()
@@ -91,17 +104,253 @@ func TestGraphiteReport(t *testing.T) {
 	for i := 0.0; i < 10; i++ {
 		child.Time("y", 10.0-i)
 	}
+	child.Gauge("z", 3)
+	child.AddToSet("w", "A")
+	snapshot.timerPercentiles = TimerPercentiles{90, 99.9}
 	snapshot.Aggregate(child)
-	report = snapshot.GraphiteReport()
-	if s, ok := assertDeepEqual(expected, report); !ok {
+	report = GraphiteReport(snapshot)
+	if s, ok := assertReportClose(expected, report); !ok {
+		t.Error(s)
+	}
+}
+
+// assertReportClose compares graphite reports line by line, allowing values to
+// differ within the accuracy of timer sketches.
+func assertReportClose(expected, result []string) (string, bool) {
+	if len(expected) == len(result) {
+		for i := range expected {
+			var eKey, rKey string
+			var eValue, rValue float64
+			var eTime, rTime int64
+			fmt.Sscanf(expected[i], "%s %f %d", &eKey, &eValue, &eTime)
+			fmt.Sscanf(result[i], "%s %f %d", &rKey, &rValue, &rTime)
+			if eKey != rKey || eTime != rTime ||
+				math.Abs(eValue-rValue) > DEFAULT_TIMER_ACCURACY*eValue {
+				break
+			}
+			if i == len(expected)-1 {
+				return "", true
+			}
+		}
+	}
+	return assertDeepEqual(expected, result)
+}
+
+func TestTimerPercentiles(t *testing.T) {
+	var percentiles TimerPercentiles
+	for _, invalid := range []string{"x", "0", "101", "50,-1"} {
+		if err := percentiles.Set(invalid); err == nil {
+			t.Errorf("expected error for %#v", invalid)
+		}
+	}
+	if err := percentiles.Set("50, 90,99.9"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := TimerPercentiles{50, 90, 99.9}
+	if s, ok := assertDeepEqual(expected, percentiles); !ok {
+		t.Error(s)
+	}
+	if percentiles.String() != "50,90,99.9" {
+		t.Errorf("expected 50,90,99.9, got %s", percentiles.String())
+	}
+	if percentileSuffix(99.9) != "99_9" {
+		t.Errorf("expected 99_9, got %s", percentileSuffix(99.9))
+	}
+}
+
+func TestSampledTimings(t *testing.T) {
+	snapshot := NewSnapshot()
+	snapshot.ProcessStatgram(Statgram{
+		Sample{key: "x", value: 10, valueType: TIMER, sampleRate: 0.1},
+		Sample{key: "x", value: 20, valueType: TIMER, sampleRate: 0.1},
+	})
+	sketch := snapshot.timings["x"]
+	if sketch.Count() != 2 || sketch.ScaledCount() != 20 {
+		t.Errorf("expected 2 timings scaled to 20, got %f scaled to %f",
+			sketch.Count(), sketch.ScaledCount())
+	}
+	if sketch.Mean() != 15 {
+		t.Errorf("expected mean of observed timings, got %f", sketch.Mean())
+	}
+	if sketch.ScaledSum() != 300 {
+		t.Errorf("expected timings scaled to sum 300, got %f",
+			sketch.ScaledSum())
+	}
+}
+
+func TestHistogramReport(t *testing.T) {
+	defer SetTimerHistograms(nil)
+	SetTimerHistograms(TimerHistograms{{"api.*", []float64{5, 10}}})
+
+	child := NewSnapshot()
+	for _, value := range []float64{1, 7, 7, 12} {
+		child.Time("api.x", value)
+	}
+	child.Time("db.x", 1)
+	snapshot := NewSnapshot()
+	snapshot.duration = time.Second
+	snapshot.Aggregate(child)
+
+	var result []string
+	for _, line := range GraphiteReport(snapshot) {
+		if strings.Contains(line, ".histogram.") {
+			result = append(result, line)
+		}
+	}
+	timestamp := fmt.Sprintf(" %d\n", snapshot.start.Unix())
+	expected := []string{
+		"stats.timers.api.x.histogram.bin_5 1.000000" + timestamp,
+		"stats.timers.api.x.histogram.bin_10 3.000000" + timestamp,
+		"stats.timers.api.x.histogram.bin_inf 4.000000" + timestamp,
+	}
+	if s, ok := assertDeepEqual(expected, result); !ok {
+		t.Error(s)
+	}
+
+	// only timers with a histogram have one stored, until the next flush
+	if len(child.histograms) != 1 || child.histograms["api.x"] == nil {
+		t.Errorf("expected only api.x's histogram, got %v", child.histograms)
+	}
+	child.Flush()
+	if len(child.histograms) != 0 {
+		t.Errorf("expected histograms cleared, got %v", child.histograms)
+	}
+}
+
+func TestNonFiniteTimings(t *testing.T) {
+	parser := NewStatgramParser()
+	snapshot := NewSnapshot()
+	snapshot.ProcessStatgram(parser.ParseStatgram([]byte(
+		"x:inf|ms\nx:1|ms\nx:-inf|ms\nx:nan|ms\nx:+Infinity|ms\nx:2|ms")))
+	sketch := snapshot.timings["x"]
+	if sketch.Count() != 2 || sketch.Min() != 1 || sketch.Max() != 2 {
+		t.Errorf("expected only finite timings, got count %v, min %v, max %v",
+			sketch.Count(), sketch.Min(), sketch.Max())
+	}
+	if len(sketch.bins) > TIMER_SKETCH_MAX_BINS {
+		t.Errorf("expected at most %d bins, got %d", TIMER_SKETCH_MAX_BINS,
+			len(sketch.bins))
+	}
+
+	snapshot.Time("y", math.Inf(1))
+	snapshot.Time("y", math.NaN())
+	if snapshot.timings["y"] != nil && snapshot.timings["y"].Count() != 0 {
+		t.Errorf("expected non-finite timings to be ignored")
+	}
+}
+
+func TestTaggedSamples(t *testing.T) {
+	parser := NewStatgramParser()
+	snapshot := NewSnapshot()
+	snapshot.ProcessStatgram(parser.ParseStatgram([]byte(
+		"x:1|c|#a:1,b:2\nx:2|c|#b:2,a:1\nx:4|c\nx:8|c|#a:2")))
+	expected := map[string]float64{"x;a=1;b=2": 3, "x": 4, "x;a=2": 8}
+	if s, ok := assertDeepEqual(expected, snapshot.counts); !ok {
+		t.Error(s)
+	}
+}
+
+func TestGauges(t *testing.T) {
+	parent := NewSnapshot()
+	parent.Gauge("x", 10)
+	parent.Gauge("y", 10)
+	a := NewSnapshot()
+	a.ProcessStatgram(Statgram{
+		Sample{key: "x", value: 5, valueType: GAUGE, delta: true},
+		Sample{key: "y", value: 1, valueType: GAUGE},
+		Sample{key: "y", value: -3, valueType: GAUGE, delta: true},
+	})
+	b := NewSnapshot()
+	b.ProcessStatgram(Statgram{
+		Sample{key: "x", value: -2, valueType: GAUGE, delta: true},
+		Sample{key: "z", value: 7, valueType: GAUGE},
+	})
+	parent.Aggregate(a)
+	parent.Aggregate(b)
+
+	expected := map[string]float64{"x": 13, "y": -2, "z": 7}
+	result := make(map[string]float64)
+	for key, gauge := range parent.gauges {
+		result[key] = gauge.value
+	}
+	if s, ok := assertDeepEqual(expected, result); !ok {
+		t.Error(s)
+	}
+
+	parent.Flush()
+	if len(parent.gauges) != 3 {
+		t.Errorf("expected gauges to survive flush, got %v", parent.gauges)
+	}
+}
+
+func TestGaugeAggregationOrder(t *testing.T) {
+	parents := make([]*Snapshot, 3)
+	for i := range parents {
+		parents[i] = NewSnapshot()
+		parents[i].Gauge("x", 100)
+	}
+	a := NewSnapshot()
+	a.Gauge("x", 1)
+	a.AdjustGauge("x", 4)
+	b := NewSnapshot()
+	b.Gauge("x", 10)
+	b.AdjustGauge("x", 1)
+	c := NewSnapshot()
+	c.AdjustGauge("x", 2)
+
+	orders := [][]*Snapshot{{a, b, c}, {c, b, a}, {b, c, a}}
+	for i, parent := range parents {
+		for _, child := range orders[i] {
+			parent.Aggregate(child)
+		}
+		if v := parent.gauges["x"].value; v != 13 {
+			t.Errorf("expected 13, got %v", v)
+		}
+		parent.Flush()
+		parent.Aggregate(c)
+		if v := parent.gauges["x"].value; v != 15 {
+			t.Errorf("expected 15 after flush, got %v", v)
+		}
+	}
+}
+
+func TestSets(t *testing.T) {
+	a := NewSnapshot()
+	a.ProcessStatgram(Statgram{
+		Sample{key: "x", valueType: SET, stringValue: "A"},
+		Sample{key: "x", valueType: SET, stringValue: "B"},
+		Sample{key: "y", valueType: SET, stringValue: "A"},
+	})
+	b := NewSnapshot()
+	b.ProcessStatgram(Statgram{
+		Sample{key: "x", valueType: SET, stringValue: "B"},
+		Sample{key: "x", valueType: SET, stringValue: "C"},
+	})
+	parent := NewSnapshot()
+	parent.Aggregate(a)
+	parent.Aggregate(b)
+
+	expected := map[string]float64{"x": 3, "y": 1}
+	result := make(map[string]float64)
+	for key, set := range parent.sets {
+		result[key] = set.Count()
+	}
+	if s, ok := assertDeepEqual(expected, result); !ok {
 		t.Error(s)
 	}
+
+	parent.Flush()
+	if len(parent.sets) != 0 {
+		t.Errorf("expected sets to be cleared by flush, got %v", parent.sets)
+	}
 }
 
 func TestStringValues(t *testing.T) {
 	statgram := Statgram{
-		Sample{"x", 10, STRING, 1.0, "A"},
-		Sample{"x", 1, STRING, 0.5, "B"},
+		Sample{key: "x", value: 10, valueType: STRING, sampleRate: 1.0,
+			stringValue: "A"},
+		Sample{key: "x", value: 1, valueType: STRING, sampleRate: 0.5,
+			stringValue: "B"},
 	}
 	snapshot := NewSnapshot()
 	snapshot.ProcessStatgram(statgram)
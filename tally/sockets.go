@@ -0,0 +1,89 @@
+package tally
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReusePort is a server option that gives each receiver its own UDP socket,
+// all bound to the same port with SO_REUSEPORT, so that the kernel spreads
+// incoming datagrams across per-receiver queues instead of funneling them all
+// through one. Only supported on Linux.
+type ReusePort bool
+
+// ReceiveBuffer is a server option setting the size in bytes of the kernel's
+// receive buffer (SO_RCVBUF) for each UDP socket. A larger buffer absorbs
+// longer bursts before datagrams are dropped. The kernel may cap the size
+// (on Linux at net.core.rmem_max).
+type ReceiveBuffer int
+
+// parseProcNetUDP reads a table in the format of /proc/net/udp, returning the
+// number of datagrams dropped by each socket, keyed by the socket's inode.
+func parseProcNetUDP(r io.Reader) (drops map[uint64]int64, err error) {
+	drops = make(map[uint64]int64)
+	scanner := bufio.NewScanner(r)
+	inodeCol, dropsCol := -1, -1
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if inodeCol < 0 {
+			// header; "tx_queue rx_queue" and "tr tm->when" each name one column
+			for i, name := range fields {
+				switch name {
+				case "inode":
+					inodeCol = i - 2
+				case "drops":
+					dropsCol = i - 2
+				}
+			}
+			continue
+		}
+		if dropsCol < 0 || len(fields) <= dropsCol || len(fields) <= inodeCol {
+			continue
+		}
+		inode, e1 := strconv.ParseUint(fields[inodeCol], 10, 64)
+		count, e2 := strconv.ParseInt(fields[dropsCol], 10, 64)
+		if e1 == nil && e2 == nil {
+			drops[inode] = count
+		}
+	}
+	return drops, scanner.Err()
+}
+
+// parseProcNetSNMP reads counters in the formats of /proc/net/snmp, where a
+// line of counter names is followed by a line of their values (each prefixed
+// by the protocol, e.g. "Udp:"), and /proc/net/snmp6, where each line holds a
+// name and its value. Counters from the former are keyed by protocol and name,
+// e.g. "Udp.RcvbufErrors"; those from the latter by name alone.
+func parseProcNetSNMP(r io.Reader) (counters map[string]int64, err error) {
+	counters = make(map[string]int64)
+	scanner := bufio.NewScanner(r)
+	var names []string
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasSuffix(fields[0], ":") {
+			if len(fields) == 2 {
+				if value, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+					counters[fields[0]] = value
+				}
+			}
+			continue
+		}
+		if names == nil || names[0] != fields[0] {
+			names = fields
+			continue
+		}
+		proto := strings.TrimSuffix(fields[0], ":")
+		for i := 1; i < len(fields) && i < len(names); i++ {
+			if value, err := strconv.ParseInt(fields[i], 10, 64); err == nil {
+				counters[proto+"."+names[i]] = value
+			}
+		}
+		names = nil
+	}
+	return counters, scanner.Err()
+}
@@ -0,0 +1,197 @@
+package tally
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// listenUDPReusePort opens a UDP socket with SO_REUSEPORT set, so that several
+// may be bound to the same address.
+func listenUDPReusePort(address string) (*net.UDPConn, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+					soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := config.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// socketInode returns the inode identifying a socket in /proc/net tables.
+func socketInode(conn syscall.Conn) (inode uint64, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var stat syscall.Stat_t
+	var statErr error
+	err = raw.Control(func(fd uintptr) {
+		statErr = syscall.Fstat(int(fd), &stat)
+	})
+	if err == nil {
+		err = statErr
+	}
+	return stat.Ino, err
+}
+
+// readBufferSize returns the size of a socket's receive buffer as reported by
+// the kernel. Linux reports twice the size that was set, the excess being
+// reserved for bookkeeping, so this is halved.
+func readBufferSize(conn syscall.Conn) (size int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_RCVBUF)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return size / 2, err
+}
+
+// udpRcvbufErrors returns the number of UDP datagrams the host has dropped
+// because a socket's receive buffer was full, over IPv4 and IPv6.
+func udpRcvbufErrors() (int64, error) {
+	var total int64
+	found := false
+	for path, name := range map[string]string{
+		"/proc/net/snmp":  "Udp.RcvbufErrors",
+		"/proc/net/snmp6": "Udp6RcvbufErrors",
+	} {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		counters, err := parseProcNetSNMP(file)
+		file.Close()
+		if err != nil {
+			return 0, err
+		}
+		if count, ok := counters[name]; ok {
+			total += count
+			found = true
+		}
+	}
+	if !found {
+		return 0, errors.New("no udp counters in /proc/net/snmp")
+	}
+	return total, nil
+}
+
+// udpDrops returns the number of datagrams dropped by each UDP socket on the
+// host, keyed by inode.
+func udpDrops() (map[uint64]int64, error) {
+	drops := make(map[uint64]int64)
+	found := false
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		table, err := parseProcNetUDP(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		for inode, count := range table {
+			drops[inode] = count
+		}
+		found = true
+	}
+	if !found {
+		return nil, errors.New("no /proc/net/udp tables available")
+	}
+	return drops, nil
+}
+
+// mmsghdr mirrors struct mmsghdr from <sys/socket.h>.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// udpBatchReader reads up to RECV_BATCH_SIZE datagrams per syscall from a
+// UDP socket using recvmmsg(2).
+type udpBatchReader struct {
+	raw       syscall.RawConn
+	hdrs      []mmsghdr
+	iovecs    []syscall.Iovec
+	bufs      [][]byte
+	datagrams [][]byte
+}
+
+// newBatchReader returns a batchReader for conn, or nil if batched reads
+// aren't supported for it.
+func newBatchReader(conn io.Reader) batchReader {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := udp.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	br := &udpBatchReader{
+		raw:       raw,
+		hdrs:      make([]mmsghdr, RECV_BATCH_SIZE),
+		iovecs:    make([]syscall.Iovec, RECV_BATCH_SIZE),
+		bufs:      make([][]byte, RECV_BATCH_SIZE),
+		datagrams: make([][]byte, RECV_BATCH_SIZE),
+	}
+	for i := range br.hdrs {
+		br.bufs[i] = make([]byte, STATGRAM_MAXSIZE)
+		br.iovecs[i].Base = &br.bufs[i][0]
+		br.iovecs[i].SetLen(STATGRAM_MAXSIZE)
+		br.hdrs[i].hdr.Iov = &br.iovecs[i]
+		br.hdrs[i].hdr.Iovlen = 1
+	}
+	return br
+}
+
+// ReadBatch blocks until at least one datagram is available, then returns as
+// many as could be read without blocking, up to RECV_BATCH_SIZE.
+func (br *udpBatchReader) ReadBatch() ([][]byte, error) {
+	var n uintptr
+	var errno syscall.Errno
+	err := br.raw.Read(func(fd uintptr) bool {
+		for {
+			n, _, errno = syscall.Syscall6(syscall.SYS_RECVMMSG, fd,
+				uintptr(unsafe.Pointer(&br.hdrs[0])), uintptr(len(br.hdrs)),
+				syscall.MSG_DONTWAIT, 0, 0)
+			if errno != syscall.EINTR {
+				// wait for the socket to become readable if it's empty
+				return errno != syscall.EAGAIN
+			}
+		}
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(n); i++ {
+		br.datagrams[i] = br.bufs[i][:br.hdrs[i].len]
+	}
+	return br.datagrams[:n], nil
+}
@@ -0,0 +1,9 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!sparc64
+
+package tally
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define. This
+// is its value from <asm-generic/socket.h>, which every architecture uses
+// except those in sockets_linux_mipsx.go and sockets_linux_sparc64.go.
+const soReusePort = 0xf
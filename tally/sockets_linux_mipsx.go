@@ -0,0 +1,8 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+// +build linux
+// +build mips mipsle mips64 mips64le
+
+package tally
+
+// soReusePort is SO_REUSEPORT, from MIPS's <asm/socket.h>.
+const soReusePort = 0x200
@@ -0,0 +1,4 @@
+package tally
+
+// soReusePort is SO_REUSEPORT, from SPARC's <asm/socket.h>.
+const soReusePort = 0x200
@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+package tally
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+var errNotLinux = errors.New("only supported on linux")
+
+func listenUDPReusePort(address string) (*net.UDPConn, error) {
+	return nil, errNotLinux
+}
+
+func socketInode(conn syscall.Conn) (uint64, error) {
+	return 0, errNotLinux
+}
+
+func readBufferSize(conn syscall.Conn) (int, error) {
+	return 0, errNotLinux
+}
+
+func udpRcvbufErrors() (int64, error) {
+	return 0, errNotLinux
+}
+
+func udpDrops() (map[uint64]int64, error) {
+	return nil, errNotLinux
+}
+
+// newBatchReader returns nil, as batched reads are only implemented on linux.
+func newBatchReader(conn io.Reader) batchReader {
+	return nil
+}
@@ -0,0 +1,157 @@
+package tally
+
+import (
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const procNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000   107        0 31337 2 0000000000000000 42
+  456: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1234 2 0000000000000000 0
+`
+
+func TestParseProcNetUDP(t *testing.T) {
+	drops, err := parseProcNetUDP(strings.NewReader(procNetUDP))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := map[uint64]int64{31337: 42, 1234: 0}
+	if s, ok := assertDeepEqual(expected, drops); !ok {
+		t.Error(s)
+	}
+}
+
+func TestListenUDPReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+	a, err := listenUDPReusePort("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := listenUDPReusePort(a.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("expected second socket on same port, got %v", err)
+	}
+	defer b.Close()
+
+	inode, err := socketInode(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drops, err := udpDrops()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := drops[inode]; !ok {
+		t.Errorf("expected socket inode %d in /proc/net/udp", inode)
+	}
+}
+
+func TestBatchedReads(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("batched reads are only supported on linux")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := NewReceiver()
+	receiver.setConn(conn)
+	if receiver.batch == nil {
+		t.Fatal("expected batched reads on a UDP connection")
+	}
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, line := range []string{"a:1|c", "b:2|ms", "c:3|g"} {
+		if _, err = client.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []Sample{
+		{key: "a", value: 1, valueType: COUNTER, sampleRate: 1},
+		{key: "b", value: 2, valueType: TIMER, sampleRate: 1},
+		{key: "c", value: 3, valueType: GAUGE, sampleRate: 1},
+	}
+	for _, sample := range expected {
+		statgram, err := receiver.ReadOnce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, ok := assertDeepEqual(Statgram{sample}, statgram); !ok {
+			t.Error(s)
+		}
+	}
+	if receiver.messageCount != 3 || receiver.byteCount != 16 {
+		t.Errorf("expected 3 messages and 16 bytes, got %d and %d",
+			receiver.messageCount, receiver.byteCount)
+	}
+
+	conn.Close()
+	if _, err = receiver.ReadOnce(); err == nil {
+		t.Error("expected an error reading from a closed connection")
+	}
+}
+
+const procNetSNMP = `Ip: Forwarding DefaultTTL InReceives
+Ip: 1 64 1000
+Udp: InDatagrams NoPorts InErrors OutDatagrams RcvbufErrors SndbufErrors
+Udp: 140 0 5 140 3 0
+`
+
+const procNetSNMP6 = `Ip6InReceives                   	52
+Udp6RcvbufErrors                	2
+`
+
+func TestParseProcNetSNMP(t *testing.T) {
+	counters, err := parseProcNetSNMP(strings.NewReader(procNetSNMP))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := map[string]int64{
+		"Ip.Forwarding": 1, "Ip.DefaultTTL": 64, "Ip.InReceives": 1000,
+		"Udp.InDatagrams": 140, "Udp.NoPorts": 0, "Udp.InErrors": 5,
+		"Udp.OutDatagrams": 140, "Udp.RcvbufErrors": 3, "Udp.SndbufErrors": 0,
+	}
+	if s, ok := assertDeepEqual(expected, counters); !ok {
+		t.Error(s)
+	}
+
+	counters, err = parseProcNetSNMP(strings.NewReader(procNetSNMP6))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected = map[string]int64{"Ip6InReceives": 52, "Udp6RcvbufErrors": 2}
+	if s, ok := assertDeepEqual(expected, counters); !ok {
+		t.Error(s)
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only supported on linux")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// small enough not to be capped by net.core.rmem_max
+	if err = conn.SetReadBuffer(8192); err != nil {
+		t.Fatal(err)
+	}
+	size, err := readBufferSize(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 8192 {
+		t.Errorf("expected receive buffer of 8192 bytes, got %d", size)
+	}
+}
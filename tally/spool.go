@@ -0,0 +1,175 @@
+package tally
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SPOOL_MAX_BYTES = 1 << 30
+	SPOOL_SEGMENT_SUFFIX    = ".report"
+)
+
+// ReportSpool is a server option enabling a spool directory, where reports
+// that can't be delivered to graphite are kept once the report queue is full,
+// and from which they're delivered when graphite recovers. Each graphite
+// destination is spooled in its own subdirectory, whose total size is capped
+// at MaxBytes, beyond which the oldest reports are dropped.
+type ReportSpool struct {
+	Dir      string
+	MaxBytes int64
+}
+
+type spoolSegment struct {
+	name string
+	size int64
+}
+
+// Spool keeps reports in a directory, one segment file per report, named by
+// the time it was spooled so that they can be replayed in order. Segments
+// remain after a restart.
+type Spool struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	segments []spoolSegment // oldest first
+	size     int64          // total of segment sizes
+	last     int64          // timestamp of the newest segment
+}
+
+// OpenSpool opens a spool directory, creating it if necessary, and finds any
+// segments left in it. Temporary files left by a crash while a segment was
+// being written are removed.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	spool := &Spool{dir: dir, maxBytes: maxBytes}
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, SPOOL_SEGMENT_SUFFIX) {
+			continue
+		}
+		if strings.HasPrefix(name, ".") {
+			err = os.Remove(filepath.Join(dir, name))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		ts, err := strconv.ParseInt(
+			strings.TrimSuffix(name, SPOOL_SEGMENT_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		spool.segments = append(spool.segments,
+			spoolSegment{name, info.Size()})
+		spool.size += info.Size()
+		if ts > spool.last {
+			spool.last = ts
+		}
+	}
+	// names are zero-padded, so they sort in time order
+	sort.Slice(spool.segments, func(i, j int) bool {
+		return spool.segments[i].name < spool.segments[j].name
+	})
+	if len(spool.segments) > 0 {
+		infolog("found %d spooled reports (%d bytes) in %s",
+			len(spool.segments), spool.size, dir)
+	}
+	return spool, nil
+}
+
+// Write adds a report to the spool as its newest segment, removing the oldest
+// segments if necessary to stay within the size cap. Returns the number of
+// reports removed, including the given one if it's too big to spool at all.
+func (spool *Spool) Write(report []byte) (dropped int, err error) {
+	size := int64(len(report))
+	if size > spool.maxBytes {
+		return 1, errors.New(fmt.Sprintf(
+			"report of %d bytes exceeds spool size", size))
+	}
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	ts := time.Now().UnixNano()
+	if ts <= spool.last {
+		ts = spool.last + 1
+	}
+	name := fmt.Sprintf("%020d%s", ts, SPOOL_SEGMENT_SUFFIX)
+	tmp := filepath.Join(spool.dir, "."+name)
+	if err = ioutil.WriteFile(tmp, report, 0644); err != nil {
+		os.Remove(tmp)
+		return 1, err
+	}
+	if err = os.Rename(tmp, filepath.Join(spool.dir, name)); err != nil {
+		os.Remove(tmp)
+		return 1, err
+	}
+	spool.last = ts
+	spool.segments = append(spool.segments, spoolSegment{name, size})
+	spool.size += size
+	for spool.size > spool.maxBytes {
+		spool.removeLocked(spool.segments[0].name)
+		dropped++
+	}
+	return dropped, nil
+}
+
+// Oldest returns the oldest spooled report and its segment name, or a nil
+// report if the spool is empty. A segment that can't be read is removed, and
+// the error returned.
+func (spool *Spool) Oldest() (name string, report []byte, err error) {
+	spool.mu.Lock()
+	if len(spool.segments) == 0 {
+		spool.mu.Unlock()
+		return
+	}
+	name = spool.segments[0].name
+	spool.mu.Unlock()
+	report, err = ioutil.ReadFile(filepath.Join(spool.dir, name))
+	if err != nil {
+		spool.Remove(name)
+		report = nil
+	}
+	return
+}
+
+// Remove deletes a segment from the spool, if it's still there.
+func (spool *Spool) Remove(name string) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	spool.removeLocked(name)
+}
+
+func (spool *Spool) removeLocked(name string) {
+	for i, segment := range spool.segments {
+		if segment.name == name {
+			err := os.Remove(filepath.Join(spool.dir, name))
+			if err != nil && !os.IsNotExist(err) {
+				errorlog("failed to remove spooled report: %s", err)
+			}
+			spool.segments = append(spool.segments[:i], spool.segments[i+1:]...)
+			spool.size -= segment.size
+			return
+		}
+	}
+}
+
+// Stats returns the number of reports spooled and their total size.
+func (spool *Spool) Stats() (reports int, size int64) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return len(spool.segments), spool.size
+}
@@ -0,0 +1,122 @@
+package tally
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tallier-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, report := range []string{"aaaa", "bbbb", "cccc"} {
+		dropped, err := spool.Write([]byte(report))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report == "cccc" && dropped != 1 {
+			t.Errorf("expected oldest report dropped to fit cap, got %d",
+				dropped)
+		}
+	}
+	if _, err = spool.Write([]byte("too big to spool")); err == nil {
+		t.Error("expected an error spooling a report larger than the cap")
+	}
+
+	// segments survive reopening, in order
+	spool, err = OpenSpool(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports, size := spool.Stats(); reports != 2 || size != 8 {
+		t.Errorf("expected 2 reports of 8 bytes, got %d of %d", reports, size)
+	}
+	for _, expected := range []string{"bbbb", "cccc"} {
+		name, report, err := spool.Oldest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(report) != expected {
+			t.Errorf("expected %#v, got %#v", expected, string(report))
+		}
+		spool.Remove(name)
+	}
+	if _, report, _ := spool.Oldest(); report != nil {
+		t.Errorf("expected empty spool, got %#v", string(report))
+	}
+}
+
+func TestSpoolRemovesTemporaryFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tallier-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// as left by a crash between writing a segment and renaming it
+	leftover := filepath.Join(dir, ".00000000000000000001"+SPOOL_SEGMENT_SUFFIX)
+	if err = ioutil.WriteFile(leftover, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spool, err := OpenSpool(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("expected temporary file to be removed, got %v", err)
+	}
+	if reports, size := spool.Stats(); reports != 0 || size != 0 {
+		t.Errorf("expected empty spool, got %d reports of %d", reports, size)
+	}
+}
+
+func TestReportQueueSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tallier-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dialer := new(bufDialer)
+	graphite, _ := NewGraphite("localhost:7", dialer)
+	queue := NewReportQueue(graphite, 1)
+	err = queue.SetSpool(ReportSpool{Dir: dir, MaxBytes: DEFAULT_SPOOL_MAX_BYTES})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Push([]byte("a 1 0\n"))
+	queue.Push([]byte("b 2 0\n"))
+	queue.Push([]byte("c 3 0\n"))
+	if spooled, _ := queue.SpoolStats(); spooled != 2 || queue.Len() != 1 {
+		t.Errorf("expected 2 reports spooled and 1 in memory, got %d and %d",
+			spooled, queue.Len())
+	}
+	if _, dropped := queue.TakeStats(); dropped != 0 {
+		t.Errorf("expected no dropped reports, got %d", dropped)
+	}
+
+	go queue.Run()
+	if err = queue.Drain(nil); err != nil {
+		t.Fatal(err)
+	}
+	if sent := dialer.buffer.String(); sent != "a 1 0\nb 2 0\nc 3 0\n" {
+		t.Errorf("expected spooled reports first, got %#v", sent)
+	}
+	if spooled, _ := queue.SpoolStats(); spooled != 0 {
+		t.Errorf("expected spool to be emptied, got %d reports", spooled)
+	}
+
+	// each destination is spooled in its own directory
+	if _, err = os.Stat(filepath.Join(dir, "localhost_7")); err != nil {
+		t.Error(err)
+	}
+}
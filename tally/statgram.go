@@ -1,12 +1,10 @@
 package tally
 
-// #include <stdlib.h>
-import "C"
-
 import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"unsafe"
@@ -18,6 +16,8 @@ const (
 	COUNTER SampleType = iota
 	TIMER
 	STRING
+	GAUGE
+	SET
 )
 
 const MAX_LINE_LEN = 1024
@@ -28,6 +28,8 @@ type Sample struct {
 	valueType   SampleType
 	sampleRate  float64
 	stringValue string
+	delta       bool   // for gauges, whether value adjusts the previous value
+	tags        string // in canonical form, see parseTags
 }
 
 type Statgram []Sample
@@ -36,10 +38,12 @@ type StatgramParser struct {
 	Statgram
 	Length         int
 	previousBuffer []byte
+	previousLen    int
 }
 
 func NewStatgramParser() *StatgramParser {
-	return &StatgramParser{make(Statgram, 1024), 0, make([]byte, MAX_LINE_LEN)}
+	return &StatgramParser{make(Statgram, 1024), 0, make([]byte, MAX_LINE_LEN),
+		0}
 }
 
 // ParseStatgram reads samples from the given text, returning a Statgram.
@@ -47,8 +51,15 @@ func NewStatgramParser() *StatgramParser {
 // provides one or more sampled values for that key. The documentation for the
 // ParseStatgramLine function explains the formatting of each line.
 func (parser *StatgramParser) ParseStatgram(datagram []byte) Statgram {
+	parser.previousLen = 0
+	return parser.ParseStream(datagram)
+}
+
+// ParseStream is like ParseStatgram, except that the first line may be
+// prefix-compressed against the last line given in the previous call. This
+// suits statgrams read from a connection in chunks of whole lines.
+func (parser *StatgramParser) ParseStream(datagram []byte) Statgram {
 	parser.Length = 0
-	previousLen := 0
 	for i := 0; i < len(datagram); i++ {
 		j := bytes.IndexByte(datagram[i:], '\n')
 		if j == -1 {
@@ -60,7 +71,7 @@ func (parser *StatgramParser) ParseStatgram(datagram []byte) Statgram {
 		i = j
 		if len(line) > 2 && line[0] == '^' {
 			prefixLen, err := strconv.ParseInt(string(line[1:3]), 16, 0)
-			if err == nil && int(prefixLen) <= previousLen {
+			if err == nil && int(prefixLen) <= parser.previousLen {
 				lineLength := int(prefixLen) + len(line) - 3
 				if lineLength <= MAX_LINE_LEN {
 					copy(parser.previousBuffer[prefixLen:], line[3:])
@@ -77,9 +88,9 @@ func (parser *StatgramParser) ParseStatgram(datagram []byte) Statgram {
 
 		if line != nil {
 			parser.ParseStatgramLine(line)
-			previousLen = len(line)
+			parser.previousLen = len(line)
 		} else {
-			previousLen = 0
+			parser.previousLen = 0
 		}
 	}
 	return parser.Statgram[:parser.Length]
@@ -88,7 +99,8 @@ func (parser *StatgramParser) ParseStatgram(datagram []byte) Statgram {
 // ParseStatgramLine reads samples from one line of a statgram. This line
 // provides a key name and one or more sampled values for that key. The key name
 // and each of the values are separated by the ':' character. The format for
-// each sampled value is explained in the documentation for ParseSample.
+// each sampled value is explained in the documentation for ParseSample. If the
+// line ends with a tag section, its tags apply to every sample on the line.
 func (parser *StatgramParser) ParseStatgramLine(line []byte) (s Statgram,
 	err error) {
 	start := parser.Length
@@ -99,7 +111,7 @@ func (parser *StatgramParser) ParseStatgramLine(line []byte) (s Statgram,
 		return
 	}
 	key := string(line[:i])
-	remainder := line[i+1:]
+	remainder, tags := splitTags(line[i+1:])
 	for len(remainder) > 0 {
 		part := remainder
 		i = bytes.IndexByte(part, ':')
@@ -114,6 +126,7 @@ func (parser *StatgramParser) ParseStatgramLine(line []byte) (s Statgram,
 		if err != nil {
 			return
 		}
+		sample.tags = tags
 		if parser.Length >= len(parser.Statgram) {
 			parser.Statgram = append(parser.Statgram, sample)
 		} else {
@@ -128,24 +141,30 @@ func (parser *StatgramParser) ParseStatgramLine(line []byte) (s Statgram,
 // ParseSample decodes a formatted string encoding a sampled value. Sampled
 // values are either counts or timings, and are also associated with a sample
 // rate. The format is:
-// <VALUE> '|' <TYPECODE> ['@' <SAMPLE_RATE>] ['|' <ENC_STRING>]
+// <VALUE> '|' <TYPECODE> ['@' <SAMPLE_RATE>] ['|' <ENC_STRING>] ['|#' <TAGS>]
 // The <VALUE> and optional <SAMPLE_RATE> tokens are floating point decimals. If
 // the sample rate annotation isn't present, then it's assumed to be 1.0 (100%).
-// The <TYPECODE> token is either 'c', 'ms', or 's', indicating a counter value,
-// timer value, or string count respectively. In the case of a string count, the
-// string being counted may be given via <ENC_STRING> (where special characters
-// such as '\', '|', ':', and the newline are escaped).
+// The <TYPECODE> token is either 'c', 'ms', 's', or 'g', indicating a counter
+// value, timer value, string count, or gauge value respectively. In the case of
+// a string count, the string being counted may be given via <ENC_STRING> (where
+// special characters such as '\', '|', ':', and the newline are escaped). A
+// gauge value with an explicit sign ('+' or '-') adjusts the gauge's previous
+// value rather than replacing it. Values and sample rates must be finite, and
+// sample rates positive.
+//
+// Set members use the <TYPECODE> 'u' (for unique), and in place of <VALUE> give
+// the member being added to the set, encoded in the same way as <ENC_STRING>.
+//
+// The optional <TAGS> are given in DogStatsD style, as a comma-separated list
+// of <NAME>':'<VALUE> pairs (e.g. "route:/api,status:200").
 func ParseSample(key string, part []byte) (sample Sample, err error) {
+	part, tags := splitTags(part)
 	i := bytes.IndexByte(part, '|')
 	if i < 0 {
 		err = errors.New("sample field should contain one or two '|' separators")
 		return
 	}
-	var value float64
-	part[i] = 0
-	if value, err = ParseFloat(part); err != nil {
-		return
-	}
+	valueField := part[:i]
 	remainder := part[i+1:]
 	typeCode := remainder
 	var suffix []byte
@@ -158,16 +177,34 @@ func ParseSample(key string, part []byte) (sample Sample, err error) {
 		err = errors.New("sample type code missing")
 		return
 	}
-	sample = Sample{key: key, value: value, sampleRate: 1.0}
+	sample = Sample{key: key, sampleRate: 1.0, tags: tags}
 	if j := bytes.IndexByte(typeCode, '@'); j >= 0 {
-		copy(typeCode[j:], typeCode[j+1:])
-		typeCode[len(typeCode)-1] = 0
-		sample.sampleRate, err = ParseFloat(typeCode[j:])
+		sample.sampleRate, err = ParseFloat(typeCode[j+1:])
 		if err != nil {
 			return
 		}
+		if !(sample.sampleRate > 0) || math.IsInf(sample.sampleRate, 0) {
+			err = errors.New("sample rate must be positive and finite")
+			return
+		}
 		typeCode = typeCode[:j]
 	}
+	if typeCode[0] == 'u' {
+		if len(valueField) == 0 {
+			err = errors.New("set member missing")
+			return
+		}
+		sample.valueType = SET
+		sample.stringValue = decodeStringSample(valueField)
+		return
+	}
+	if sample.value, err = ParseFloat(valueField); err != nil {
+		return
+	}
+	if math.IsInf(sample.value, 0) || math.IsNaN(sample.value) {
+		err = errors.New("sample value must be finite")
+		return
+	}
 	switch typeCode[0] {
 	case 'c':
 		sample.valueType = COUNTER
@@ -176,6 +213,9 @@ func ParseSample(key string, part []byte) (sample Sample, err error) {
 	case 's':
 		sample.valueType = STRING
 		sample.stringValue = decodeStringSample(suffix)
+	case 'g':
+		sample.valueType = GAUGE
+		sample.delta = part[0] == '+' || part[0] == '-'
 	default:
 		err = errors.New(fmt.Sprintf("invalid sample type code %#v", typeCode))
 	}
@@ -215,13 +255,155 @@ func decodeStringSample(b []byte) string {
 	return string(b[:j])
 }
 
-// b must be NUL-terminated
+var errParseFloat = errors.New("error parsing float")
+
+// ParseFloat parses the longest prefix of b that forms a floating point number,
+// accepting the same syntax as C's strtod: optional leading whitespace and
+// sign, followed by a decimal number with optional exponent, a hexadecimal
+// number ("0x" prefix, optional binary exponent), "inf", "infinity", or "nan".
+// Trailing bytes that aren't part of the number are ignored. An error is
+// returned only if no number can be parsed. Values out of range become
+// infinities or zero, as with strtod. No memory is allocated in the common
+// case.
+//
+// Infinities and NaN are parsed for compatibility with strtod, but ParseSample
+// rejects them, since no statistic can meaningfully accumulate them.
 func ParseFloat(b []byte) (f float64, e error) {
-	cbuf := (*C.char)(unsafe.Pointer(&b[0]))
-	endptr := (*C.char)(nil)
-	f = float64(C.strtod(cbuf, &endptr))
-	if endptr == cbuf {
-		e = errors.New("error parsing float")
+	i := 0
+	for i < len(b) && isSpace(b[i]) {
+		i++
+	}
+	start := i
+	neg := false
+	if i < len(b) && (b[i] == '+' || b[i] == '-') {
+		neg = b[i] == '-'
+		i++
+	}
+	// "inf" and "infinity" parse alike, since any bytes after the number are
+	// ignored anyway
+	if matchFold(b[i:], "inf") == 3 {
+		f = math.Inf(1)
+		if neg {
+			f = -f
+		}
+		return
+	}
+	if matchFold(b[i:], "nan") == 3 {
+		return math.NaN(), nil
+	}
+	if i+1 < len(b) && b[i] == '0' && (b[i+1] == 'x' || b[i+1] == 'X') {
+		if f, ok := parseHexFloat(b[i+2:]); ok {
+			if neg {
+				f = -f
+			}
+			return f, nil
+		}
+	}
+
+	// find the extent of the decimal number, then let strconv convert it
+	digits := 0
+	for i < len(b) && isDigit(b[i]) {
+		i++
+		digits++
+	}
+	if i < len(b) && b[i] == '.' {
+		i++
+		for i < len(b) && isDigit(b[i]) {
+			i++
+			digits++
+		}
+	}
+	if digits == 0 {
+		return 0, errParseFloat
+	}
+	if i < len(b) && (b[i] == 'e' || b[i] == 'E') {
+		j := i + 1
+		if j < len(b) && (b[j] == '+' || b[j] == '-') {
+			j++
+		}
+		if j < len(b) && isDigit(b[j]) {
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	number := b[start:i]
+	f, err := strconv.ParseFloat(*(*string)(unsafe.Pointer(&number)), 64)
+	if err != nil && err.(*strconv.NumError).Err != strconv.ErrRange {
+		e = errParseFloat
 	}
 	return
 }
+
+// parseHexFloat parses the hex digits and optional binary exponent following a
+// "0x" prefix. If no digits are present, ok is false and the caller should
+// parse the leading "0" on its own, as strtod does.
+func parseHexFloat(b []byte) (f float64, ok bool) {
+	i := 0
+	exp := 0
+	fraction := false
+	for ; i < len(b); i++ {
+		var d byte
+		switch c := b[i]; {
+		case isDigit(c):
+			d = c - '0'
+		case c >= 'a' && c <= 'f':
+			d = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			d = c - 'A' + 10
+		case c == '.' && !fraction:
+			fraction = true
+			continue
+		default:
+			goto done
+		}
+		f = f*16 + float64(d)
+		ok = true
+		if fraction {
+			exp -= 4
+		}
+	}
+done:
+	if !ok {
+		return
+	}
+	if i < len(b) && (b[i] == 'p' || b[i] == 'P') {
+		j := i + 1
+		neg := false
+		if j < len(b) && (b[j] == '+' || b[j] == '-') {
+			neg = b[j] == '-'
+			j++
+		}
+		pexp := 0
+		for ; j < len(b) && isDigit(b[j]); j++ {
+			if pexp < 100000 {
+				pexp = pexp*10 + int(b[j]-'0')
+			}
+		}
+		if j > i+1 && isDigit(b[j-1]) {
+			if neg {
+				pexp = -pexp
+			}
+			exp += pexp
+		}
+	}
+	return math.Ldexp(f, exp), true
+}
+
+// matchFold returns how many leading bytes of b match s, ignoring case.
+func matchFold(b []byte, s string) int {
+	n := 0
+	for n < len(b) && n < len(s) && b[n]|0x20 == s[n] {
+		n++
+	}
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || (c >= '\t' && c <= '\r')
+}
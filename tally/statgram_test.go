@@ -2,8 +2,10 @@ package tally
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -50,6 +52,48 @@ func TestParseSample(t *testing.T) {
 	}
 }
 
+func TestParseGaugeSample(t *testing.T) {
+	expected := Sample{key: "test", value: 42, valueType: GAUGE,
+		sampleRate: 1.0}
+	sample, _ := ParseSample("test", []byte("42|g"))
+	if expected != sample {
+		t.Errorf("expected %#v, got %#v", expected, sample)
+	}
+
+	expected.value = 3
+	expected.delta = true
+	sample, _ = ParseSample("test", []byte("+3|g"))
+	if expected != sample {
+		t.Errorf("expected %#v, got %#v", expected, sample)
+	}
+
+	expected.value = -1
+	sample, _ = ParseSample("test", []byte("-1|g"))
+	if expected != sample {
+		t.Errorf("expected %#v, got %#v", expected, sample)
+	}
+}
+
+func TestParseSetSample(t *testing.T) {
+	_, err := ParseSample("test", []byte("|u"))
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	expected := Sample{key: "test", valueType: SET, sampleRate: 1.0,
+		stringValue: "10.0.0.1"}
+	sample, _ := ParseSample("test", []byte("10.0.0.1|u"))
+	if expected != sample {
+		t.Errorf("expected %#v, got %#v", expected, sample)
+	}
+
+	expected.stringValue = "a:b"
+	sample, _ = ParseSample("test", []byte("a\\;b|u"))
+	if expected != sample {
+		t.Errorf("expected %#v, got %#v", expected, sample)
+	}
+}
+
 func TestParseStatgramLine(t *testing.T) {
 	parser := NewStatgramParser()
 	statgram, err := parser.ParseStatgramLine(nil)
@@ -103,6 +147,36 @@ func TestParseStatgramLine(t *testing.T) {
 	}
 }
 
+func TestParseTaggedStatgramLine(t *testing.T) {
+	parser := NewStatgramParser()
+	expected := Statgram{
+		Sample{key: "test", value: 1.0, valueType: COUNTER, sampleRate: 1.0,
+			tags: "route=/api:v2;status=200"},
+		Sample{key: "test", value: 2.0, valueType: TIMER, sampleRate: 0.1,
+			tags: "route=/api:v2;status=200"},
+	}
+	statgram, err := parser.ParseStatgramLine(
+		[]byte("test:1|c:2|ms@0.1|#status:200,route:/api:v2"))
+	if err != nil {
+		t.Error("expected statgram, got error:", err)
+	}
+	if s, ok := assertDeepEqual(expected, statgram); !ok {
+		t.Error(s)
+	}
+
+	expected = Statgram{
+		Sample{key: "test", valueType: STRING, sampleRate: 1.0,
+			stringValue: "x", tags: "a=b"},
+	}
+	statgram, err = parser.ParseStatgramLine([]byte("test:0|s|x|#a:b"))
+	if err != nil {
+		t.Error("expected statgram, got error:", err)
+	}
+	if s, ok := assertDeepEqual(expected, statgram); !ok {
+		t.Error(s)
+	}
+}
+
 func TestParseStatgram(t *testing.T) {
 	expected := Statgram{
 		Sample{key: "x", value: 1.0, valueType: COUNTER, sampleRate: 1.0},
@@ -149,10 +223,104 @@ func BenchmarkParseStatgram(b *testing.B) {
 	runtime.ReadMemStats(&ms)
 	s := ms.HeapObjects
 	parser := NewStatgramParser()
+	buf := make([]byte, len(bs))
 	for i := 0; i < b.N; i++ {
-		parser.ParseStatgram(bs)
+		// parsing modifies the buffer in place, so start fresh each time
+		copy(buf, bs)
+		parser.ParseStatgram(buf)
 	}
 	runtime.GC()
 	runtime.ReadMemStats(&ms)
 	fmt.Fprintf(os.Stderr, "N=%d, heap objects: %d\n", b.N, ms.HeapObjects-s)
 }
+
+func TestParseFloat(t *testing.T) {
+	inf, nan := math.Inf(1), math.NaN()
+	tests := []struct {
+		input    string
+		expected float64
+		ok       bool
+		strconv  bool // whether strconv.ParseFloat accepts the same input
+	}{
+		{"1", 1, true, true},
+		{"-0.5", -0.5, true, true},
+		{"+.5", 0.5, true, true},
+		{"5.", 5, true, true},
+		{"6.02e23", 6.02e23, true, true},
+		{"1E-3", 1e-3, true, true},
+		{"1e+2", 100, true, true},
+		{"1e400", inf, true, true},
+		{"-1e400", -inf, true, true},
+		{"1e-400", 0, true, true},
+		{"1e99999999999999999999", inf, true, true},
+		{"inf", inf, true, true},
+		{"-Inf", -inf, true, true},
+		{"+INFINITY", inf, true, true},
+		{"nan", nan, true, true},
+		{"NaN", nan, true, true},
+		{"0x1p-2", 0.25, true, true},
+		{"-0X1.8P1", -3, true, true},
+		{"0x10", 16, true, false},
+		{"0x", 0, true, false},
+		{"0xg", 0, true, false},
+		{" \t1", 1, true, false},
+		{"1.5abc", 1.5, true, false},
+		{"1e", 1, true, false},
+		{"1e+", 1, true, false},
+		{"infin", inf, true, false},
+		{"nanx", nan, true, false},
+		{"", 0, false, false},
+		{" ", 0, false, false},
+		{"-", 0, false, false},
+		{".", 0, false, false},
+		{"e5", 0, false, false},
+		{"in", 0, false, false},
+		{"na", 0, false, false},
+		{"x1", 0, false, false},
+	}
+	same := func(a, b float64) bool {
+		return a == b && math.Signbit(a) == math.Signbit(b) ||
+			math.IsNaN(a) && math.IsNaN(b)
+	}
+	for _, test := range tests {
+		f, err := ParseFloat([]byte(test.input))
+		if (err == nil) != test.ok {
+			t.Errorf("%#v: expected ok=%v, got error %v", test.input, test.ok,
+				err)
+			continue
+		}
+		if !same(f, test.expected) {
+			t.Errorf("%#v: expected %v, got %v", test.input, test.expected, f)
+		}
+		expected, err := strconv.ParseFloat(test.input, 64)
+		if strconvOK := err == nil || err.(*strconv.NumError).Err ==
+			strconv.ErrRange; strconvOK != test.strconv {
+			t.Errorf("%#v: expected strconv ok=%v, got error %v", test.input,
+				test.strconv, err)
+		} else if strconvOK && !same(f, expected) {
+			t.Errorf("%#v: strconv parsed %v, got %v", test.input, expected, f)
+		}
+	}
+}
+
+func TestParseNonFiniteSample(t *testing.T) {
+	for _, part := range []string{"inf|c", "-inf|g", "nan|ms", "1e400|c",
+		"1|c@0", "1|c@-1", "1|c@nan", "1|c@inf"} {
+		if _, err := ParseSample("test", []byte(part)); err == nil {
+			t.Errorf("%#v: expected error", part)
+		}
+	}
+}
+
+func BenchmarkParseFloat(b *testing.B) {
+	inputs := [][]byte{
+		[]byte("1\x00"), []byte("0.1\x00"), []byte("-1234.5678\x00"),
+		[]byte("6.02e23\x00"),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseFloat(inputs[i%len(inputs)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -42,6 +42,11 @@ func ServeStatus(server *Server) error {
 			errorlog("error: %s", err)
 		}
 	}
+	for _, backend := range server.backends.Backends() {
+		if h, ok := backend.(HTTPBackend); ok {
+			http.Handle(h.Path(), h)
+		}
+	}
 	if err == nil {
 		addr := fmt.Sprintf("%s:%d", server.receiverHost, server.receiverPort)
 		go http.ListenAndServe(addr, nil)
@@ -97,12 +102,41 @@ func (statusPage) getTemplate() string {
         <h4><a href="/strings/tallier.samples">top stats</a></h4>
         <h4><a href="/strings/">strings</a><h4>
         <h4><a href="/debug/pprof">cpu profile</a></h4>
+{{range .pages}}
+        <h4><a href="{{.}}">{{.}}</a></h4>
+{{end}}
+{{with .backends}}
+        <h4>backends</h4>
+        <ul>
+        {{range $name, $status := .}}<li>{{$name}}: {{$status}}</li>{{end}}
+        </ul>
+{{end}}
+{{with .reload}}
+        <h4>configuration reloaded {{.Time.Format "2006-01-02 15:04:05"}}</h4>
+        {{if .Error}}<p>failed: {{.Error}}</p>{{end}}
+        {{if .Applied}}<p>applied: {{range .Applied}}{{.}} {{end}}</p>{{end}}
+        {{if .RequiresRestart}}
+        <p>requires restart: {{range .RequiresRestart}}{{.}} {{end}}</p>
+        {{end}}
+{{end}}
 `
 }
 
 func (statusPage) handle(req *StatusRequest) {
-	// this function only exists to register the handler
-	req.data = map[string]interface{}{}
+	var pages []string
+	for _, backend := range req.s.backends.Backends() {
+		if h, ok := backend.(HTTPBackend); ok {
+			pages = append(pages, h.Path())
+		}
+	}
+	data := map[string]interface{}{
+		"backends": req.s.backends.Statuses(),
+		"pages":    pages,
+	}
+	if reload := req.s.LastReload(); !reload.Time.IsZero() {
+		data["reload"] = reload
+	}
+	req.data = data
 }
 
 type stringsPage struct{}
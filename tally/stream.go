@@ -0,0 +1,136 @@
+package tally
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// StreamServer accepts connections that send newline-delimited statgrams, as
+// an alternative to UDP for clients that can't afford to lose samples. Each
+// connection is parsed as one long statgram, so prefix-compressed lines may
+// refer back to lines sent earlier on the same connection. Parsed statgrams
+// are delivered on a channel shared with the receivers.
+type StreamServer struct {
+	name        string // used in internal stats, e.g. "tcp"
+	listener    net.Listener
+	statgrams   chan Statgram
+	connections int64 // number currently open, accessed atomically
+
+	mu     sync.Mutex
+	open   map[io.Closer]bool // connections being read, for closing them
+	closed bool
+	wg     sync.WaitGroup // for connections being read
+}
+
+func NewStreamServer(name string, listener net.Listener,
+	statgrams chan Statgram) *StreamServer {
+	return &StreamServer{
+		name:      name,
+		listener:  listener,
+		statgrams: statgrams,
+		open:      make(map[io.Closer]bool),
+	}
+}
+
+// Serve accepts connections until the listener is closed, reading statgrams
+// from each in its own goroutine.
+func (ss *StreamServer) Serve() error {
+	for {
+		conn, err := ss.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go ss.ReadStatgrams(conn)
+	}
+}
+
+func (ss *StreamServer) Connections() int64 {
+	return atomic.LoadInt64(&ss.connections)
+}
+
+// Close stops accepting connections and closes those that are open, returning
+// once the statgrams already read from them have been delivered.
+func (ss *StreamServer) Close() error {
+	err := ss.listener.Close()
+	ss.mu.Lock()
+	ss.closed = true
+	for conn := range ss.open {
+		conn.Close()
+	}
+	ss.mu.Unlock()
+	ss.wg.Wait()
+	return err
+}
+
+// track registers a connection to be closed by Close, returning false if the
+// server is already closed.
+func (ss *StreamServer) track(conn io.Closer) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return false
+	}
+	ss.open[conn] = true
+	ss.wg.Add(1)
+	return true
+}
+
+func (ss *StreamServer) untrack(conn io.Closer) {
+	ss.mu.Lock()
+	delete(ss.open, conn)
+	ss.mu.Unlock()
+	ss.wg.Done()
+}
+
+// ReadStatgrams parses lines from conn until it's closed. Lines are parsed in
+// batches of up to STATGRAM_MAXSIZE bytes, or as many as have been received,
+// whichever is smaller. Lines longer than MAX_LINE_LEN are discarded.
+func (ss *StreamServer) ReadStatgrams(conn io.ReadCloser) {
+	if !ss.track(conn) {
+		conn.Close()
+		return
+	}
+	defer ss.untrack(conn)
+	atomic.AddInt64(&ss.connections, 1)
+	defer atomic.AddInt64(&ss.connections, -1)
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, STATGRAM_MAXSIZE)
+	parser := NewStatgramParser()
+	batch := make([]byte, 0, STATGRAM_MAXSIZE)
+	flush := func() {
+		if statgram := parser.ParseStream(batch); len(statgram) > 0 {
+			// the parser reuses its buffer, so send a copy
+			ss.statgrams <- append(Statgram(nil), statgram...)
+		}
+		batch = batch[:0]
+	}
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > MAX_LINE_LEN+1 || err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			infolog("discarding overlong line from %s client", ss.name)
+			// a compressed line can't refer to the discarded one
+			flush()
+			parser.previousLen = 0
+			line = nil
+		}
+		batch = append(batch, line...)
+		if err != nil || reader.Buffered() == 0 ||
+			len(batch) > STATGRAM_MAXSIZE-MAX_LINE_LEN {
+			flush()
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				errorlog("%s client read error: %s", ss.name, err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package tally
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func collectStatgrams(statgrams chan Statgram) (result Statgram) {
+	for statgram := range statgrams {
+		result = append(result, statgram...)
+	}
+	return
+}
+
+func TestReadStatgrams(t *testing.T) {
+	expected := Statgram{
+		Sample{key: "x", value: 1.0, valueType: COUNTER, sampleRate: 1.0},
+		Sample{key: "x", value: 2.0, valueType: COUNTER, sampleRate: 1.0},
+		Sample{key: "y", value: 3.0, valueType: TIMER, sampleRate: 1.0},
+		Sample{key: "z", value: 4.0, valueType: COUNTER, sampleRate: 1.0},
+	}
+	statgrams := make(chan Statgram)
+	ss := NewStreamServer("test", nil, statgrams)
+	input := "x:1|c\n^022|c\n" + strings.Repeat("w", 2000) + ":1|c\n" +
+		"^01bad:1|c\ny:3|ms\nz:4|c"
+	go func() {
+		ss.ReadStatgrams(ioutil.NopCloser(strings.NewReader(input)))
+		close(statgrams)
+	}()
+	if s, ok := assertDeepEqual(expected, collectStatgrams(statgrams)); !ok {
+		t.Error(s)
+	}
+}
+
+func TestStreamServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	statgrams := make(chan Statgram)
+	ss := NewStreamServer("test", listener, statgrams)
+	go ss.Serve()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("abc.def:1|c\n"))
+	conn.Write([]byte("^04ghi:2|c\n"))
+
+	expected := Statgram{
+		Sample{key: "abc.def", value: 1.0, valueType: COUNTER, sampleRate: 1.0},
+		Sample{key: "abc.ghi", value: 2.0, valueType: COUNTER, sampleRate: 1.0},
+	}
+	// the lines may arrive in one batch or two
+	var result Statgram
+	for len(result) < len(expected) {
+		result = append(result, <-statgrams...)
+	}
+	if s, ok := assertDeepEqual(expected, result); !ok {
+		t.Error(s)
+	}
+	if ss.Connections() != 1 {
+		t.Errorf("expected 1 open connection, got %d", ss.Connections())
+	}
+}
+
+func TestStreamServerClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statgrams := make(chan Statgram)
+	ss := NewStreamServer("test", listener, statgrams)
+	go ss.Serve()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("x:1|c\n"))
+	expected := Statgram{
+		Sample{key: "x", value: 1.0, valueType: COUNTER, sampleRate: 1.0}}
+	if s, ok := assertDeepEqual(expected, <-statgrams); !ok {
+		t.Error(s)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		ss.Close()
+		close(closed)
+	}()
+	<-closed
+	if ss.Connections() != 0 {
+		t.Errorf("expected no open connections, got %d", ss.Connections())
+	}
+	if _, err = net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("expected the listener to be closed")
+	}
+}
@@ -0,0 +1,107 @@
+package tally
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tagged stats are kept in snapshots under a key that appends the sample's
+// tags to its name in graphite's tagged series format, with the tags sorted
+// by name: "<NAME>;<TAG>=<VALUE>;<TAG>=<VALUE>". Samples with the same name
+// and tags are therefore aggregated together regardless of the order their
+// tags were sent in.
+
+// TagFormat selects how the tags of a stat are rendered in graphite paths.
+type TagFormat int
+
+const (
+	// TAGS_AS_GRAPHITE_TAGS renders graphite 1.1 tagged series, e.g.
+	// "stats.timers.x.upper;route=/api;status=200".
+	TAGS_AS_GRAPHITE_TAGS TagFormat = iota
+	// TAGS_AS_PATH renders tags as path components following the name, e.g.
+	// "stats.timers.x.route_-api.status_200.upper".
+	TAGS_AS_PATH
+)
+
+var tagFormatNames = []string{"graphite", "path"}
+
+func (format *TagFormat) String() string {
+	return tagFormatNames[*format]
+}
+
+func (format *TagFormat) Set(value string) error {
+	for i, name := range tagFormatNames {
+		if value == name {
+			*format = TagFormat(i)
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("tag format must be one of: %s",
+		strings.Join(tagFormatNames, ", ")))
+}
+
+var tagCharReplacer = strings.NewReplacer(";", "_", "=", "_", " ", "_")
+var pathCharReplacer = strings.NewReplacer(".", "_", "/", "-", " ", "_")
+
+// splitTags removes a trailing tag section ('|#' followed by comma-separated
+// tags) from a sample field, returning the remainder and the tags in their
+// canonical form.
+func splitTags(b []byte) (rest []byte, tags string) {
+	i := bytes.Index(b, []byte("|#"))
+	if i < 0 {
+		return b, ""
+	}
+	return b[:i], parseTags(b[i+2:])
+}
+
+// parseTags converts DogStatsD-style tags ("route:/api,status:200") to the
+// canonical form used in stat keys ("route=/api;status=200"). A tag given
+// without a value is assigned the value "true".
+func parseTags(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	fields := strings.Split(string(b), ",")
+	tags := fields[:0]
+	for _, field := range fields {
+		if field == "" {
+			continue
+		}
+		name, value := field, "true"
+		if i := strings.IndexByte(field, ':'); i >= 0 {
+			name, value = field[:i], field[i+1:]
+		}
+		tags = append(tags, tagCharReplacer.Replace(name)+"="+
+			tagCharReplacer.Replace(value))
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ";")
+}
+
+// tagKey returns the snapshot key for a stat with the given name and tags.
+func tagKey(name, tags string) string {
+	if tags == "" {
+		return name
+	}
+	return name + ";" + tags
+}
+
+// splitStatKey separates a snapshot key into the stat's name and its tags.
+func splitStatKey(key string) (name, tags string) {
+	if i := strings.IndexByte(key, ';'); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+// tagsAsPath renders canonical tags as graphite path components.
+func tagsAsPath(tags string) string {
+	parts := strings.Split(tags, ";")
+	for i, tag := range parts {
+		parts[i] = pathCharReplacer.Replace(strings.Replace(tag, "=", "_", 1))
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,72 @@
+package tally
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	expected := "env=true;route=/api;status=200"
+	result := parseTags([]byte("status:200,route:/api,,env"))
+	if expected != result {
+		t.Errorf("expected %#v, got %#v", expected, result)
+	}
+	expected = "a_b=c_d"
+	result = parseTags([]byte("a=b:c;d"))
+	if expected != result {
+		t.Errorf("expected %#v, got %#v", expected, result)
+	}
+}
+
+func TestTagFormat(t *testing.T) {
+	var format TagFormat
+	if err := format.Set("xml"); err == nil {
+		t.Error("expected error")
+	}
+	if err := format.Set("path"); err != nil || format != TAGS_AS_PATH {
+		t.Errorf("expected path format, got %v (%v)", format, err)
+	}
+}
+
+func TestTaggedGraphiteReport(t *testing.T) {
+	child := NewSnapshot()
+	child.ProcessStatgram(Statgram{
+		Sample{key: "x", value: 1, valueType: COUNTER, sampleRate: 1,
+			tags: "route=/api;status=200"},
+		Sample{key: "y", value: 2, valueType: GAUGE, tags: "a=b"},
+	})
+	snapshot := NewSnapshot()
+	snapshot.duration = time.Second
+	snapshot.Aggregate(child)
+	timestamp := fmt.Sprintf(" %d\n", snapshot.start.Unix())
+
+	expected := map[string]bool{
+		"stats.x;route=/api;status=200 1.000000" + timestamp:        true,
+		"stats_counts.x;route=/api;status=200 1.000000" + timestamp: true,
+		"stats.gauges.y;a=b 2.000000" + timestamp:                   true,
+	}
+	result := make(map[string]bool)
+	for _, line := range GraphiteReport(snapshot) {
+		result[line] = true
+	}
+	if s, ok := assertDeepEqual(expected, result); !ok {
+		t.Error(s)
+	}
+
+	snapshot.tagFormat = TAGS_AS_PATH
+	path := snapshot.StatPath("stats.timers.", "x;route=/api;status=200",
+		".upper")
+	if path != "stats.timers.x.route_-api.status_200.upper" {
+		t.Errorf("unexpected path %#v", path)
+	}
+	path = snapshot.StatPath("stats.timers.", "x;a=b", ".upper")
+	if path != "stats.timers.x.a_b.upper" {
+		t.Errorf("unexpected path %#v", path)
+	}
+	snapshot.tagFormat = TAGS_AS_GRAPHITE_TAGS
+	path = snapshot.StatPath("stats.timers.", "x;a=b", ".upper")
+	if path != "stats.timers.x.upper;a=b" {
+		t.Errorf("unexpected path %#v", path)
+	}
+}
@@ -0,0 +1,257 @@
+package tally
+
+import (
+	"errors"
+	"math"
+)
+
+const DEFAULT_TIMER_ACCURACY = 0.01
+
+// TIMER_SKETCH_MAX_BINS bounds the memory used by each timer. At the default
+// accuracy this covers more than nine orders of magnitude before the lowest
+// bins start to be collapsed together.
+const TIMER_SKETCH_MAX_BINS = 2048
+
+// timings at or below this value are counted together in the zero bin
+const TIMER_SKETCH_MIN_VALUE = 1e-9
+
+var timerGamma, timerLogGamma float64
+
+func init() {
+	SetTimerAccuracy(DEFAULT_TIMER_ACCURACY)
+}
+
+// SetTimerAccuracy sets the relative accuracy of the quantiles reported for
+// timers. For example, with an accuracy of 0.01 a reported upper_90 is within
+// 1% of the true value. This must be called before any timings are collected,
+// since sketches of different accuracies can't be merged.
+func SetTimerAccuracy(accuracy float64) error {
+	if !(accuracy > 0 && accuracy < 1) {
+		return errors.New("timer accuracy must be between 0 and 1")
+	}
+	timerGamma = (1 + accuracy) / (1 - accuracy)
+	timerLogGamma = math.Log(timerGamma)
+	return nil
+}
+
+// TimerSketch summarizes a distribution of timings in bounded memory. Values
+// are counted in logarithmically sized bins, so that any quantile can be
+// estimated within a fixed relative error (this is the DDSketch algorithm).
+// The count, sum, minimum, and maximum are tracked exactly. Sketches merge
+// cheaply by adding their bins together.
+//
+// Timings reported at a sample rate below 1 are summarized as observed, but
+// each also contributes 1/rate to the scaled count, which estimates how many
+// timings actually occurred, and value/rate to the scaled sum.
+type TimerSketch struct {
+	count       float64
+	scaledCount float64
+	sum         float64
+	scaledSum   float64
+	sumSq       float64
+	min         float64
+	max         float64
+	zeroCount   float64
+	offset      int       // bin index of bins[0]
+	bins        []float64 // counts of positive values, by bin index
+}
+
+func NewTimerSketch() *TimerSketch {
+	return &TimerSketch{}
+}
+
+func (sketch *TimerSketch) Count() float64 {
+	return sketch.count
+}
+
+// ScaledCount estimates the number of timings that occurred, accounting for
+// the sample rates they were reported at.
+func (sketch *TimerSketch) ScaledCount() float64 {
+	return sketch.scaledCount
+}
+
+func (sketch *TimerSketch) Sum() float64 {
+	return sketch.sum
+}
+
+// ScaledSum estimates the sum of the timings that occurred, accounting for the
+// sample rates they were reported at, to go with ScaledCount.
+func (sketch *TimerSketch) ScaledSum() float64 {
+	return sketch.scaledSum
+}
+
+func (sketch *TimerSketch) Min() float64 {
+	return sketch.min
+}
+
+func (sketch *TimerSketch) Max() float64 {
+	return sketch.max
+}
+
+func (sketch *TimerSketch) Mean() float64 {
+	return sketch.sum / sketch.count
+}
+
+// StdDev returns the population standard deviation of the timings.
+func (sketch *TimerSketch) StdDev() float64 {
+	mean := sketch.Mean()
+	return math.Sqrt(math.Max(0, sketch.sumSq/sketch.count-mean*mean))
+}
+
+// binIndex returns the index of the bin covering a positive value. Values too
+// large to be finite share the highest bin.
+func binIndex(value float64) int {
+	value = math.Min(value, math.MaxFloat64)
+	return int(math.Ceil(math.Log(value) / timerLogGamma))
+}
+
+func binValue(index int) float64 {
+	return 2 * math.Pow(timerGamma, float64(index)) / (timerGamma + 1)
+}
+
+// Add records one timing.
+func (sketch *TimerSketch) Add(value float64) {
+	sketch.AddSampled(value, 1)
+}
+
+// AddSampled records one timing that was reported at the given sample rate.
+// Timings that aren't finite are ignored.
+func (sketch *TimerSketch) AddSampled(value, sampleRate float64) {
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return
+	}
+	if sketch.count == 0 || value < sketch.min {
+		sketch.min = value
+	}
+	if sketch.count == 0 || value > sketch.max {
+		sketch.max = value
+	}
+	sketch.count++
+	sketch.scaledCount += 1 / sampleRate
+	sketch.sum += value
+	sketch.scaledSum += value / sampleRate
+	sketch.sumSq += value * value
+	if value <= TIMER_SKETCH_MIN_VALUE {
+		sketch.zeroCount++
+		return
+	}
+	sketch.addToBin(binIndex(value), 1)
+}
+
+// addToBin grows the bins to cover the given index, so that they always span
+// exactly the range of indexes observed, and adds to the count there.
+func (sketch *TimerSketch) addToBin(index int, count float64) {
+	switch {
+	case len(sketch.bins) == 0:
+		sketch.offset = index
+		sketch.bins = append(sketch.bins, 0)
+	case index < sketch.offset:
+		grown := make([]float64, sketch.offset-index+len(sketch.bins))
+		copy(grown[sketch.offset-index:], sketch.bins)
+		sketch.bins = grown
+		sketch.offset = index
+	case index >= sketch.offset+len(sketch.bins):
+		for index >= sketch.offset+len(sketch.bins) {
+			sketch.bins = append(sketch.bins, 0)
+		}
+	}
+	sketch.bins[index-sketch.offset] += count
+	if len(sketch.bins) > TIMER_SKETCH_MAX_BINS {
+		sketch.collapse()
+	}
+}
+
+// collapse folds the lowest bins into one so the sketch stays within
+// TIMER_SKETCH_MAX_BINS, trading accuracy at the bottom of the distribution.
+func (sketch *TimerSketch) collapse() {
+	excess := len(sketch.bins) - TIMER_SKETCH_MAX_BINS
+	for _, count := range sketch.bins[:excess] {
+		sketch.bins[excess] += count
+	}
+	copy(sketch.bins, sketch.bins[excess:])
+	sketch.bins = sketch.bins[:TIMER_SKETCH_MAX_BINS]
+	sketch.offset += excess
+}
+
+// Merge folds the timings summarized by other into this sketch.
+func (sketch *TimerSketch) Merge(other *TimerSketch) {
+	if other.count == 0 {
+		return
+	}
+	if sketch.count == 0 || other.min < sketch.min {
+		sketch.min = other.min
+	}
+	if sketch.count == 0 || other.max > sketch.max {
+		sketch.max = other.max
+	}
+	sketch.count += other.count
+	sketch.scaledCount += other.scaledCount
+	sketch.sum += other.sum
+	sketch.scaledSum += other.scaledSum
+	sketch.sumSq += other.sumSq
+	sketch.zeroCount += other.zeroCount
+	for i, count := range other.bins {
+		if count != 0 {
+			sketch.addToBin(other.offset+i, count)
+		}
+	}
+}
+
+// Quantile estimates the timing at the given quantile (between 0 and 1) using
+// the nearest-rank method.
+func (sketch *TimerSketch) Quantile(q float64) float64 {
+	if sketch.count == 0 {
+		return 0
+	}
+	rank := math.Max(0, math.Ceil(q*sketch.count)-1)
+	if rank < sketch.zeroCount {
+		return sketch.min
+	}
+	seen := sketch.zeroCount
+	value := sketch.max
+	for i, count := range sketch.bins {
+		seen += count
+		if seen > rank {
+			value = binValue(sketch.offset + i)
+			break
+		}
+	}
+	return math.Max(sketch.min, math.Min(sketch.max, value))
+}
+
+// Lower estimates the number and sum of the timings at or below the given
+// quantile, as used for statsd's mean_N and sum_N statistics.
+func (sketch *TimerSketch) Lower(q float64) (count, sum float64) {
+	if sketch.count == 0 {
+		return
+	}
+	count = math.Min(sketch.count, math.Ceil(q*sketch.count))
+	if count == sketch.count {
+		return count, sketch.sum
+	}
+	remaining := count - math.Min(count, sketch.zeroCount)
+	for i := 0; i < len(sketch.bins) && remaining > 0; i++ {
+		n := math.Min(remaining, sketch.bins[i])
+		value := binValue(sketch.offset + i)
+		sum += n * math.Max(sketch.min, math.Min(sketch.max, value))
+		remaining -= n
+	}
+	return
+}
+
+// Reset empties the sketch while keeping its allocated bins for reuse.
+func (sketch *TimerSketch) Reset() {
+	sketch.count = 0
+	sketch.scaledCount = 0
+	sketch.sum = 0
+	sketch.scaledSum = 0
+	sketch.sumSq = 0
+	sketch.min = 0
+	sketch.max = 0
+	sketch.zeroCount = 0
+	sketch.offset = 0
+	for i := range sketch.bins {
+		sketch.bins[i] = 0
+	}
+	sketch.bins = sketch.bins[:0]
+}
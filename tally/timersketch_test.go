@@ -0,0 +1,134 @@
+package tally
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func assertWithinAccuracy(t *testing.T, q, expected, result float64) {
+	if math.Abs(result-expected) > DEFAULT_TIMER_ACCURACY*expected {
+		t.Errorf("quantile %v: expected %f, got %f", q, expected, result)
+	}
+}
+
+func TestTimerSketch(t *testing.T) {
+	sketch := NewTimerSketch()
+	if sketch.Quantile(0.5) != 0 {
+		t.Errorf("expected empty sketch to report 0, got %f",
+			sketch.Quantile(0.5))
+	}
+
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = math.Exp(rand.NormFloat64()*2 + 3)
+		sketch.Add(values[i])
+	}
+	sort.Float64s(values)
+	for _, q := range []float64{0.1, 0.5, 0.9, 0.99, 0.999} {
+		expected := values[int(math.Ceil(q*float64(len(values))))-1]
+		assertWithinAccuracy(t, q, expected, sketch.Quantile(q))
+	}
+	if sketch.Min() != values[0] || sketch.Max() != values[len(values)-1] {
+		t.Errorf("expected exact bounds %f, %f; got %f, %f",
+			values[0], values[len(values)-1], sketch.Min(), sketch.Max())
+	}
+	if sketch.Count() != float64(len(values)) {
+		t.Errorf("expected count %d, got %f", len(values), sketch.Count())
+	}
+
+	sketch.Reset()
+	if sketch.Count() != 0 || len(sketch.bins) != 0 {
+		t.Errorf("expected empty sketch after reset, got %+v", sketch)
+	}
+}
+
+func TestTimerSketchLower(t *testing.T) {
+	sketch := NewTimerSketch()
+	for i := 1; i <= 100; i++ {
+		sketch.Add(float64(i))
+	}
+	count, sum := sketch.Lower(0.5)
+	if count != 50 {
+		t.Errorf("expected count of 50, got %f", count)
+	}
+	assertWithinAccuracy(t, 0.5, 1275, sum)
+	count, sum = sketch.Lower(1)
+	if count != 100 || sum != 5050 {
+		t.Errorf("expected exact count and sum, got %f, %f", count, sum)
+	}
+	if sd := sketch.StdDev(); math.Abs(sd-math.Sqrt(833.25)) > 1e-9 {
+		t.Errorf("expected stddev %f, got %f", math.Sqrt(833.25), sd)
+	}
+}
+
+func TestTimerSketchZeroes(t *testing.T) {
+	sketch := NewTimerSketch()
+	for i := 0; i < 5; i++ {
+		sketch.Add(0)
+	}
+	sketch.Add(100)
+	if q := sketch.Quantile(0.5); q != 0 {
+		t.Errorf("expected median of 0, got %f", q)
+	}
+	if q := sketch.Quantile(1); q != 100 {
+		t.Errorf("expected maximum of 100, got %f", q)
+	}
+}
+
+func TestTimerSketchMerge(t *testing.T) {
+	a := NewTimerSketch()
+	b := NewTimerSketch()
+	all := NewTimerSketch()
+	for i := 1; i <= 1000; i++ {
+		a.Add(float64(i))
+		b.Add(float64(i * 1000))
+		all.Add(float64(i))
+	}
+	for i := 1; i <= 1000; i++ {
+		all.Add(float64(i * 1000))
+	}
+	a.Merge(b)
+	if s, ok := assertDeepEqual(all, a); !ok {
+		t.Error(s)
+	}
+}
+
+func TestTimerSketchCollapse(t *testing.T) {
+	sketch := NewTimerSketch()
+	var values []float64
+	for v := 1e-6; v < 1e12; v *= 1.001 {
+		sketch.Add(v)
+		values = append(values, v)
+	}
+	if len(sketch.bins) > TIMER_SKETCH_MAX_BINS {
+		t.Errorf("expected at most %d bins, got %d", TIMER_SKETCH_MAX_BINS,
+			len(sketch.bins))
+	}
+	expected := values[int(math.Ceil(0.99*float64(len(values))))-1]
+	assertWithinAccuracy(t, 0.99, expected, sketch.Quantile(0.99))
+}
+
+func TestTimerSketchNonFinite(t *testing.T) {
+	if binIndex(math.Inf(1)) != binIndex(math.MaxFloat64) {
+		t.Errorf("expected infinity to share the highest bin, got %d",
+			binIndex(math.Inf(1)))
+	}
+	sketch := NewTimerSketch()
+	sketch.Add(math.Inf(1))
+	sketch.Add(math.NaN())
+	sketch.Add(1)
+	if sketch.Count() != 1 || sketch.Max() != 1 || len(sketch.bins) != 1 {
+		t.Errorf("expected non-finite timings to be ignored, got %#v", sketch)
+	}
+}
+
+func TestSetTimerAccuracy(t *testing.T) {
+	if err := SetTimerAccuracy(0); err == nil {
+		t.Error("expected error")
+	}
+	if err := SetTimerAccuracy(1); err == nil {
+		t.Error("expected error")
+	}
+}
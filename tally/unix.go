@@ -0,0 +1,142 @@
+package tally
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync/atomic"
+)
+
+// UnixSockets is a server option enabling listeners on unix domain sockets,
+// for clients on the same host (e.g. containers sharing a volume mount). Either
+// path may be empty to leave that listener disabled. The socket files are
+// given the configured mode, and owner and group if these are set.
+type UnixSockets struct {
+	DatagramPath string
+	StreamPath   string
+	Mode         os.FileMode
+	Owner        string
+	Group        string
+}
+
+// listenDatagram opens the datagram socket, replacing any stale socket file.
+func (opts UnixSockets) listenDatagram() (*net.UnixConn, error) {
+	if err := removeStaleSocket(opts.DatagramPath); err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUnixAddr("unixgram", opts.DatagramPath)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = opts.setPermissions(opts.DatagramPath); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listenStream opens the stream socket, replacing any stale socket file.
+func (opts UnixSockets) listenStream() (net.Listener, error) {
+	if err := removeStaleSocket(opts.StreamPath); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", opts.StreamPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = opts.setPermissions(opts.StreamPath); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New(fmt.Sprintf("%s exists and is not a socket", path))
+	}
+	return os.Remove(path)
+}
+
+func (opts UnixSockets) setPermissions(path string) error {
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			return err
+		}
+	}
+	uid, gid := -1, -1
+	if opts.Owner != "" {
+		u, err := user.Lookup(opts.Owner)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+	}
+	if opts.Group != "" {
+		g, err := user.LookupGroup(opts.Group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// datagramCounts tallies the datagrams read by forwardDatagrams, which may be
+// running in several goroutines at once.
+type datagramCounts struct {
+	messages int64
+	bytes    int64
+}
+
+// take returns the counts since the last call, and resets them.
+func (counts *datagramCounts) take() (messages, bytes int64) {
+	return atomic.SwapInt64(&counts.messages, 0),
+		atomic.SwapInt64(&counts.bytes, 0)
+}
+
+// forwardDatagrams reads and parses statgrams from conn until it's closed,
+// passing them on to the receivers over the given channel and tallying them in
+// counts. Several of these may share one connection to parse in parallel.
+func forwardDatagrams(conn io.Reader, statgrams chan Statgram,
+	counts *datagramCounts) error {
+	receiver := NewReceiver()
+	receiver.setConn(conn)
+	for {
+		statgram, err := receiver.ReadOnce()
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&counts.messages,
+			receiver.messageCount-receiver.lastMessageCount)
+		atomic.AddInt64(&counts.bytes, receiver.byteCount-receiver.lastByteCount)
+		receiver.lastMessageCount = receiver.messageCount
+		receiver.lastByteCount = receiver.byteCount
+		if len(statgram) > 0 {
+			// the parser reuses its buffer, so send a copy
+			statgrams <- append(Statgram(nil), statgram...)
+		}
+	}
+}
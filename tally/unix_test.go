@@ -0,0 +1,77 @@
+package tally
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tallier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := UnixSockets{
+		DatagramPath: filepath.Join(dir, "dgram.sock"),
+		StreamPath:   filepath.Join(dir, "stream.sock"),
+		Mode:         0600,
+	}
+
+	// a stale socket from a previous run should be replaced
+	stale, err := net.Listen("unix", opts.StreamPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := opts.listenStream()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	conn, err := opts.listenDatagram()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	for _, path := range []string{opts.DatagramPath, opts.StreamPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("expected mode 0600 for %s, got %v", path, info.Mode())
+		}
+	}
+
+	statgrams := make(chan Statgram)
+	var counts datagramCounts
+	go forwardDatagrams(conn, statgrams, &counts)
+	client, err := net.Dial("unixgram", opts.DatagramPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("x:1|c"))
+	expected := Statgram{
+		Sample{key: "x", value: 1.0, valueType: COUNTER, sampleRate: 1.0}}
+	if s, ok := assertDeepEqual(expected, <-statgrams); !ok {
+		t.Error(s)
+	}
+	if messages, bytes := counts.take(); messages != 1 || bytes != 5 {
+		t.Errorf("expected 1 message of 5 bytes, got %d of %d", messages, bytes)
+	}
+	if messages, bytes := counts.take(); messages != 0 || bytes != 0 {
+		t.Errorf("expected counts to be reset, got %d of %d", messages, bytes)
+	}
+
+	notSocket := UnixSockets{StreamPath: filepath.Join(dir, "file")}
+	ioutil.WriteFile(notSocket.StreamPath, nil, 0600)
+	if _, err = notSocket.listenStream(); err == nil {
+		t.Error("expected error when path is not a socket")
+	}
+}